@@ -15,13 +15,14 @@ func BenchmarkConnectionWrite(b *testing.B) {
 		b.Error(err)
 	}
 
-	conn := &connection{
+	conn := &Conn{
 		rw:                &testReadWriteCloser{},
 		recv:              lockstitch.NewProtocol("recv"),
 		send:              lockstitch.NewProtocol("send"),
 		localKey:          k,
 		remoteKey:         k.PublicKey(),
 		sendBuf:           make([]byte, 1024*1024*10),
+		state:             ConnectionState{MaxFrameSize: maxFrameLen},
 		lastRatchet:       time.Now(),
 		ratchetAfterBytes: math.MaxInt,
 		ratchetAfterTime:  10 * time.Hour,
@@ -7,17 +7,68 @@ import (
 	"log"
 	"net"
 	"os"
+
+	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/hostprompt"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
 )
 
-var addr = flag.String("addr", "127.0.0.1:4040", "the address to connect to")
+var (
+	addr     = flag.String("addr", "127.0.0.1:4040", "the address to connect to")
+	isPath   = flag.String("client_key", "", "the path to the private key file of the client, if any")
+	rsPath   = flag.String("server_key", "", "the path to the public key file of the server, if any")
+	khPath   = flag.String("known_hosts", "", "the path to the known hosts file to use if -server_key is not specified")
+	anon     = flag.Bool("anonymous", false, "securely connect without a client key, authenticating only the server")
+	hostKeys = yrgourd.AskHostKeys
+)
 
 func main() {
+	flag.TextVar(&hostKeys, "host_keys", yrgourd.AskHostKeys, "how to handle servers not in -known_hosts: strict, tofu, or ask")
 	flag.Parse()
 
-	log.Println("connecting to", *addr)
-	conn, err := net.Dial("tcp", *addr)
-	if err != nil {
-		log.Fatal(err)
+	var conn io.ReadWriteCloser
+	if *isPath != "" || *anon {
+		dialer := &yrgourd.Dialer{}
+		if *isPath != "" {
+			is, err := keyfile.ReadPrivateKey(*isPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Println("client key", yrgourd.Fingerprint(is.PublicKey()))
+			dialer.Key = is
+		}
+
+		var err error
+		switch {
+		case *rsPath != "":
+			dialer.ServerKey, err = keyfile.ReadPublicKey(*rsPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		case *khPath != "":
+			dialer.KnownHosts, err = yrgourd.LoadKnownHosts(*khPath, hostKeys)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dialer.KnownHosts.Ask = hostprompt.Ask
+		default:
+			log.Fatal("must specify either -server_key or -known_hosts with -client_key or -anonymous")
+		}
+
+		log.Println("securely connecting to", *addr)
+		yrConn, err := dialer.Dial("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("connected with server key", yrgourd.Fingerprint(yrConn.RemoteKey()))
+		conn = yrConn
+	} else {
+		log.Println("connecting to", *addr)
+		netConn, err := net.Dial("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn = netConn
 	}
 	defer func() {
 		_ = conn.Close()
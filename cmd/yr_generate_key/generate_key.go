@@ -2,19 +2,58 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
+)
+
+var (
+	out          = flag.String("out", "yrgourd.key", "the path to write the private key to; the public key is written to the same path with a .pub suffix")
+	format       = flag.String("format", keyfile.Hex, "the key encoding: hex, base64, or pem")
+	derivePublic = flag.String("derive_public", "", "print the public key for the given private key file instead of generating a new key")
+	randomart    = flag.Bool("randomart", false, "also print a randomart visualization of the public key's fingerprint")
 )
 
 func main() {
+	flag.Parse()
+
+	if *derivePublic != "" {
+		k, err := keyfile.ReadPrivateKey(*derivePublic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pub, err := keyfile.EncodePublicKey(k.PublicKey(), *format)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		_, _ = os.Stdout.Write(pub)
+		printFingerprint(k.PublicKey())
+		return
+	}
+
 	k, err := yrgourd.GenerateKey(rand.Reader)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("private key: %s\n", hex.EncodeToString(k.Bytes()))
-	fmt.Printf("public key: %s\n", hex.EncodeToString(k.PublicKey().Bytes()))
+	if err := keyfile.WriteKeyPair(*out, k, *format); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("private key: %s\n", *out)
+	fmt.Printf("public key: %s.pub\n", *out)
+	printFingerprint(k.PublicKey())
+}
+
+func printFingerprint(k *yrgourd.PublicKey) {
+	fmt.Printf("fingerprint: %s\n", yrgourd.Fingerprint(k))
+	if *randomart {
+		fmt.Println(yrgourd.Randomart(k))
+	}
 }
@@ -2,44 +2,64 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"io"
 	"log"
 	"net"
+	"time"
 
 	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/hostprompt"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
 )
 
 var (
-	listen  = flag.String("listen", "127.0.0.1:6060", "the address to listen on")
-	connect = flag.String("connect", "127.0.0.1:5050", "the address to connect to")
-	isStr   = flag.String("client_key", "", "the private key of the client")
-	rsStr   = flag.String("server_key", "", "the public key of the server")
+	listen    = flag.String("listen", "127.0.0.1:6060", "the address to listen on")
+	connect   = flag.String("connect", "127.0.0.1:5050", "the address to connect to")
+	isPath    = flag.String("client_key", "", "the path to the private key file of the client")
+	rsPath    = flag.String("server_key", "", "the path to the public key file of the server, if any")
+	khPath    = flag.String("known_hosts", "", "the path to the known hosts file to use if -server_key is not specified; the server must allow discovery unless its key is already pinned")
+	keepalive = flag.Duration("keepalive", 30*time.Second, "how long a connection may be idle before it is pinged; the peer is considered dead after four times this; 0 disables keepalives")
+	hostKeys  = yrgourd.AskHostKeys
 )
 
 func main() {
+	flag.TextVar(&hostKeys, "host_keys", yrgourd.AskHostKeys, "how to handle servers not in -known_hosts: strict, tofu, or ask")
 	flag.Parse()
 
-	isB, err := hex.DecodeString(*isStr)
+	is, err := keyfile.ReadPrivateKey(*isPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("client key", yrgourd.Fingerprint(is.PublicKey()))
 
-	is, err := yrgourd.NewPrivateKey(isB)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Ratchet long-lived connections even while they sit idle.
+	config := yrgourd.DefaultConfig
+	config.RatchetInBackground = true
 
-	rsB, err := hex.DecodeString(*rsStr)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Cache resumption tickets so reconnections can use abbreviated handshakes.
+	config.SessionCache = yrgourd.NewSessionCache(64)
 
-	rs, err := yrgourd.NewPublicKey(rsB)
-	if err != nil {
-		log.Fatal(err)
+	// Ping idle connections so they aren't dropped, and give up on peers which stop responding.
+	config.KeepaliveInterval = *keepalive
+	config.IdleTimeout = 4 * *keepalive
+	dialer := &yrgourd.Dialer{Key: is, Config: &config}
+	switch {
+	case *rsPath != "":
+		dialer.ServerKey, err = keyfile.ReadPublicKey(*rsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("server key", yrgourd.Fingerprint(dialer.ServerKey))
+	case *khPath != "":
+		dialer.KnownHosts, err = yrgourd.LoadKnownHosts(*khPath, hostKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialer.KnownHosts.Ask = hostprompt.Ask
+		log.Println("using known hosts from", *khPath, "in", hostKeys, "mode")
+	default:
+		log.Fatal("must specify either -server_key or -known_hosts")
 	}
 
 	listener, err := net.Listen("tcp", *listen)
@@ -63,20 +83,15 @@ func main() {
 			}()
 
 			log.Println("connecting to", *connect)
-			client, err := net.Dial("tcp", *connect)
+			yrClient, err := dialer.Dial("tcp", *connect)
 			if err != nil {
 				log.Println("error connecting", err)
 				return
 			}
 			defer func() {
-				_ = client.Close()
+				_ = yrClient.Close()
 			}()
-
-			yrClient, err := yrgourd.Initiate(client, is, rs, rand.Reader, nil)
-			if err != nil {
-				log.Println("error connecting", err)
-				return
-			}
+			log.Println("connected to", *connect, "with server key", yrgourd.Fingerprint(yrClient.RemoteKey()))
 
 			ctx, cancel := context.WithCancel(context.Background())
 			go func() {
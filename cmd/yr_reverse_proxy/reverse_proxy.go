@@ -3,34 +3,58 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
 )
 
 var (
-	listen  = flag.String("listen", "127.0.0.1:5050", "the address to listen on")
-	connect = flag.String("connect", "127.0.0.1:4040", "the address to connect to")
-	rsStr   = flag.String("server_key", "", "the private key of the server")
+	listen    = flag.String("listen", "127.0.0.1:5050", "the address to listen on")
+	connect   = flag.String("connect", "127.0.0.1:4040", "the address to connect to")
+	discovery = flag.Bool("allow_discovery", false, "reveal the primary server key to clients which don't know it, e.g. yr_proxy with -known_hosts")
+	tickets   = flag.Duration("ticket_lifetime", 24*time.Hour, "how long resumption tickets remain valid; 0 disables resumption")
+	keepalive = flag.Duration("keepalive", 30*time.Second, "how long a connection may be idle before it is pinged; the peer is considered dead after four times this; 0 disables keepalives")
 )
 
 func main() {
+	var rsPaths pathsFlag
+	flag.Var(&rsPaths, "server_key", "the path to a private key file of the server; may be repeated to accept multiple keys, the first of which is the primary key")
 	flag.Parse()
 
-	rsB, err := hex.DecodeString(*rsStr)
-	if err != nil {
-		log.Fatal(err)
+	if len(rsPaths) == 0 {
+		log.Fatal("must specify at least one -server_key")
 	}
 
-	rs, err := yrgourd.NewPrivateKey(rsB)
-	if err != nil {
-		log.Fatal(err)
+	var keys []*yrgourd.PrivateKey
+	for _, path := range rsPaths {
+		rs, err := keyfile.ReadPrivateKey(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("server key", yrgourd.Fingerprint(rs.PublicKey()), "from", path)
+		keys = append(keys, rs)
+	}
+
+	// Ratchet long-lived connections even while they sit idle.
+	config := yrgourd.DefaultConfig
+	config.RatchetInBackground = true
+	config.AllowDiscovery = *discovery
+
+	if *tickets > 0 {
+		config.TicketKeys = yrgourd.NewTicketKeys(rand.Reader)
+		config.TicketLifetime = *tickets
 	}
 
+	// Ping idle connections so they aren't dropped, and give up on peers which stop responding.
+	config.KeepaliveInterval = *keepalive
+	config.IdleTimeout = 4 * *keepalive
+
 	listener, err := net.Listen("tcp", *listen)
 	if err != nil {
 		log.Fatal(err)
@@ -45,15 +69,16 @@ func main() {
 		}
 
 		go func() {
-			yrConn, err := yrgourd.Respond(conn, rs, rand.Reader, nil, yrgourd.AllowAllPolicy)
+			yrConn, err := yrgourd.RespondKeys(conn, keys, rand.Reader, &config, yrgourd.AllowAllPolicy)
 			if err != nil {
 				log.Println("error responding", err)
+				_ = conn.Close()
 				return
 			}
 
-			log.Println("accepted new connection")
+			log.Println("accepted new connection from", yrgourd.Fingerprint(yrConn.RemoteKey()), "with server key", yrgourd.Fingerprint(yrConn.LocalKey()))
 			defer func() {
-				_ = conn.Close()
+				_ = yrConn.Close()
 				log.Println("closed connection")
 			}()
 
@@ -84,3 +109,14 @@ func main() {
 		}()
 	}
 }
+
+type pathsFlag []string
+
+func (p *pathsFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathsFlag) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
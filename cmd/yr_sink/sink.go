@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/ecdh"
 	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"io"
 	"log"
@@ -11,31 +10,32 @@ import (
 	"time"
 
 	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
 )
 
 var (
-	addr  = flag.String("addr", "127.0.0.1:4040", "the address to listen on")
-	rsStr = flag.String("server_key", "", "the private key of the server, if any")
+	addr   = flag.String("addr", "127.0.0.1:4040", "the address to listen on")
+	rsPath = flag.String("server_key", "", "the path to the private key file of the server, if any")
+	anon   = flag.Bool("allow_anonymous", false, "accept handshakes from clients without a client key")
 )
 
 func main() {
 	flag.Parse()
 
 	var rs *ecdh.PrivateKey
-	if *rsStr != "" {
-		rsB, err := hex.DecodeString(*rsStr)
+	if *rsPath != "" {
+		var err error
+		rs, err = keyfile.ReadPrivateKey(*rsPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		rs, err = yrgourd.NewPrivateKey(rsB)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		log.Println("listening for yrgourd connections")
+		log.Println("listening for yrgourd connections with server key", yrgourd.Fingerprint(rs.PublicKey()))
 	}
 
+	config := yrgourd.DefaultConfig
+	config.AllowAnonymous = *anon
+
 	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatal(err)
@@ -51,18 +51,25 @@ func main() {
 
 		go func(conn net.Conn) {
 			log.Println("accepted new connection")
+			// Close the yrgourd connection, if any, so it sends a close_notify frame and stops its background tasks.
+			var rw io.ReadWriteCloser = conn
 			defer func() {
-				_ = conn.Close()
+				_ = rw.Close()
 				log.Println("closed connection")
 			}()
 
-			var rw io.ReadWriter = conn
 			if rs != nil {
-				rw, err = yrgourd.Respond(conn, rs, rand.Reader, nil, yrgourd.AllowAllPolicy)
+				yrConn, err := yrgourd.Respond(conn, rs, rand.Reader, &config, yrgourd.AllowAllPolicy)
 				if err != nil {
 					log.Println("error during handshake", err)
 					return
 				}
+				if yrConn.ConnectionState().Anonymous {
+					log.Println("anonymous handshake")
+				} else {
+					log.Println("handshake from", yrgourd.Fingerprint(yrConn.RemoteKey()))
+				}
+				rw = yrConn
 			}
 
 			start := time.Now()
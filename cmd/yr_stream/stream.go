@@ -3,48 +3,46 @@ package main
 import (
 	"crypto/ecdh"
 	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"io"
 	"log"
 	"net"
 
 	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
 )
 
 var (
-	addr  = flag.String("addr", "127.0.0.1:4040", "the address to connect to")
-	size  = flag.Int64("size", 1024*1024*1024, "the number of bytes to write")
-	isStr = flag.String("client_key", "", "the private key of the client, if any")
-	rsStr = flag.String("server_key", "", "the public key of the server, if any")
+	addr   = flag.String("addr", "127.0.0.1:4040", "the address to connect to")
+	size   = flag.Int64("size", 1024*1024*1024, "the number of bytes to write")
+	isPath = flag.String("client_key", "", "the path to the private key file of the client, if any")
+	rsPath = flag.String("server_key", "", "the path to the public key file of the server, if any")
+	anon   = flag.Bool("anonymous", false, "connect without a client key; requires -server_key and a server with -allow_anonymous")
 )
 
 func main() {
 	flag.Parse()
 
-	if (*isStr == "" && *rsStr != "") || (*isStr != "" && *rsStr == "") {
+	if *anon {
+		if *isPath != "" || *rsPath == "" {
+			log.Fatalf("-anonymous requires -server_key and no -client_key")
+		}
+	} else if (*isPath == "" && *rsPath != "") || (*isPath != "" && *rsPath == "") {
 		log.Fatalf("must specify either both -client_key and -server_key or neither")
 	}
 
 	var is *ecdh.PrivateKey
 	var rs *ecdh.PublicKey
-	if *isStr != "" && *rsStr != "" {
-		isB, err := hex.DecodeString(*isStr)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		is, err = yrgourd.NewPrivateKey(isB)
+	if *isPath != "" {
+		var err error
+		is, err = keyfile.ReadPrivateKey(*isPath)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		rsB, err := hex.DecodeString(*rsStr)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		rs, err = yrgourd.NewPublicKey(rsB)
+	}
+	if *rsPath != "" {
+		var err error
+		rs, err = keyfile.ReadPublicKey(*rsPath)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -55,24 +53,31 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Close the yrgourd connection, if any, so it sends a close_notify frame and stops its background tasks.
+	var rw io.ReadWriteCloser = conn
 	defer func() {
-		_ = conn.Close()
+		_ = rw.Close()
 	}()
 
-	var rw io.ReadWriter = conn
-	if is != nil && rs != nil {
-		log.Println("securely connecting to", *addr)
+	switch {
+	case is != nil:
+		log.Println("securely connecting to", *addr, "with server key", yrgourd.Fingerprint(rs))
 		rw, err = yrgourd.Initiate(conn, is, rs, rand.Reader, nil)
 		if err != nil {
 			log.Fatal(err)
 		}
+	case rs != nil:
+		log.Println("anonymously connecting to", *addr, "with server key", yrgourd.Fingerprint(rs))
+		rw, err = yrgourd.InitiateAnonymous(conn, rs, rand.Reader, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	buf := make([]byte, 1024*1024)
 	if _, err := io.CopyBuffer(rw, io.LimitReader(constReader{b: 0x22}, *size), buf); err != nil {
 		log.Println("error writing data", err)
 	}
-
 }
 
 type constReader struct {
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
+)
+
+// readAuthorizedKeys reads a file of public keys, one per line in hex or base64. Blank lines and lines starting with
+// '#' are ignored.
+func readAuthorizedKeys(path string) ([]*yrgourd.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*yrgourd.PublicKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		k, err := keyfile.ParsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
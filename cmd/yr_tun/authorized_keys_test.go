@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
+)
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	a, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aHex, err := keyfile.EncodePublicKey(a.PublicKey(), keyfile.Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bBase64, err := keyfile.EncodePublicKey(b.PublicKey(), keyfile.Base64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	data := "# a comment\n" + string(aHex) + "\n" + string(bBase64)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := readAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := 2, len(keys); expected != actual {
+		t.Fatalf("expected %d keys but was %d", expected, actual)
+	}
+
+	if !keys[0].Equal(a.PublicKey()) || !keys[1].Equal(b.PublicKey()) {
+		t.Error("authorized key mismatch")
+	}
+}
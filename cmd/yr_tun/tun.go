@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codahale/yrgourd-go"
+	"github.com/codahale/yrgourd-go/internal/keyfile"
+)
+
+var (
+	listen    = flag.String("listen", "", "the address to listen on, as the server")
+	connect   = flag.String("connect", "", "the address to connect to, as the client")
+	ckPath    = flag.String("client_key", "", "the path to the private key file of the client")
+	skPath    = flag.String("server_key", "", "the path to the private key file of the server, or to its public key file with -connect")
+	akPath    = flag.String("authorized_keys", "", "the path to a file of client public keys to allow; required with -listen")
+	tunName   = flag.String("tun", "yr0", "the name of the TUN device to create or use")
+	socket    = flag.String("socket", "", "the local UDP address to relay raw IP packets through instead of a TUN device, for testing without root; this is not a network stack")
+	keepalive = flag.Duration("keepalive", 30*time.Second, "how long a connection may be idle before it is pinged; the peer is considered dead after four times this; 0 disables keepalives")
+)
+
+func main() {
+	flag.Parse()
+
+	dev, err := openDevice()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Ping idle connections so they aren't dropped, and give up on peers which stop responding. Connections ratchet in
+	// the background, so long-lived tunnels get fresh keys even when idle.
+	config := yrgourd.DefaultConfig
+	config.RatchetInBackground = true
+	config.KeepaliveInterval = *keepalive
+	config.IdleTimeout = 4 * *keepalive
+
+	// Send packets read from the device to the current connection.
+	r := new(router)
+	go r.forward(dev)
+
+	switch {
+	case *listen != "" && *connect == "":
+		serve(dev, r, &config)
+	case *connect != "" && *listen == "":
+		dial(dev, r, &config)
+	default:
+		log.Fatal("must specify either -listen or -connect")
+	}
+}
+
+// openDevice opens the TUN device or, if -socket is specified, a UDP socket which carries IP packets.
+func openDevice() (io.ReadWriteCloser, error) {
+	if *socket != "" {
+		pc, err := net.ListenPacket("udp", *socket)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("exchanging packets on", pc.LocalAddr())
+		return &socketDevice{pc: pc}, nil
+	}
+
+	dev, err := openTUN(*tunName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("opened TUN device %s; configure it with e.g. `ip addr add 10.0.0.1/24 dev %[1]s && ip link set %[1]s up`", *tunName)
+	return dev, nil
+}
+
+// serve accepts connections from clients. The most recent connection carries the tunnel's packets.
+func serve(dev io.Writer, r *router, config *yrgourd.Config) {
+	rs, err := keyfile.ReadPrivateKey(*skPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("server key", yrgourd.Fingerprint(rs.PublicKey()))
+
+	// The most recent connection takes over the tunnel, so only known clients may connect.
+	if *akPath == "" {
+		log.Fatal("-listen requires -authorized_keys")
+	}
+	authorized, err := readAuthorizedKeys(*akPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %d authorized keys", len(authorized))
+
+	policy := func(key *yrgourd.PublicKey, _ []byte) bool {
+		return slices.ContainsFunc(authorized, func(k *yrgourd.PublicKey) bool { return k.Equal(key) })
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("listening on", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("failed to accept connection", err)
+			continue
+		}
+
+		go func() {
+			yrConn, err := yrgourd.Respond(conn, rs, rand.Reader, config, policy)
+			if err != nil {
+				log.Println("error responding", err)
+				_ = conn.Close()
+				return
+			}
+			log.Println("accepted new connection from", yrgourd.Fingerprint(yrConn.RemoteKey()))
+
+			tunnel(dev, r, yrConn)
+		}()
+	}
+}
+
+// dial connects to the server, reconnecting whenever the connection fails.
+func dial(dev io.Writer, r *router, config *yrgourd.Config) {
+	is, err := keyfile.ReadPrivateKey(*ckPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("client key", yrgourd.Fingerprint(is.PublicKey()))
+
+	rs, err := keyfile.ReadPublicKey(*skPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("server key", yrgourd.Fingerprint(rs))
+
+	dialer := &yrgourd.Dialer{Key: is, ServerKey: rs, Config: config}
+	for {
+		log.Println("connecting to", *connect)
+		yrConn, err := dialer.Dial("tcp", *connect)
+		if err != nil {
+			log.Println("error connecting", err)
+		} else {
+			log.Println("connected to", *connect)
+			tunnel(dev, r, yrConn)
+		}
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// tunnel makes the connection the current one and writes the packets it receives to the device until it fails.
+func tunnel(dev io.Writer, r *router, conn *yrgourd.Conn) {
+	r.set(conn)
+	defer func() {
+		r.clear(conn)
+		_ = conn.Close()
+		log.Println("closed connection")
+	}()
+
+	for {
+		packet, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("error reading packet", err)
+			}
+			return
+		}
+
+		if _, err := dev.Write(packet); err != nil {
+			log.Println("error writing packet to device", err)
+		}
+	}
+}
+
+// A router sends packets read from the device to the current connection, if any.
+type router struct {
+	mu   sync.Mutex
+	conn *yrgourd.Conn
+}
+
+// set makes conn the current connection, closing the previous one.
+func (r *router) set(conn *yrgourd.Conn) {
+	r.mu.Lock()
+	prev := r.conn
+	r.conn = conn
+	r.mu.Unlock()
+
+	if prev != nil {
+		_ = prev.Close()
+	}
+}
+
+// clear forgets conn, if it's the current connection.
+func (r *router) clear(conn *yrgourd.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == conn {
+		r.conn = nil
+	}
+}
+
+// forward reads packets from the device and sends each one as a single message, dropping them if there's no
+// connection.
+func (r *router) forward(dev io.Reader) {
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			log.Fatal("error reading packet from device ", err)
+		}
+
+		r.mu.Lock()
+		conn := r.conn
+		r.mu.Unlock()
+
+		if conn == nil {
+			continue
+		}
+
+		if err := conn.WriteMessage(buf[:n]); err != nil {
+			log.Println("error sending packet", err)
+		}
+	}
+}
+
+// A socketDevice carries IP packets in UDP datagrams, replying to the address which most recently sent one. It is a
+// stand-in for a TUN device which doesn't need root, not a userspace network stack: it relays whatever packets the
+// local program sends it without interpreting them, so that program must build and parse IP packets itself.
+type socketDevice struct {
+	pc   net.PacketConn
+	mu   sync.Mutex
+	peer net.Addr
+}
+
+func (d *socketDevice) Read(p []byte) (int, error) {
+	n, addr, err := d.pc.ReadFrom(p)
+	if err != nil {
+		return 0, err
+	}
+
+	d.mu.Lock()
+	d.peer = addr
+	d.mu.Unlock()
+	return n, nil
+}
+
+func (d *socketDevice) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	peer := d.peer
+	d.mu.Unlock()
+
+	// Drop packets until something has sent one to the socket.
+	if peer == nil {
+		return len(p), nil
+	}
+	return d.pc.WriteTo(p, peer)
+}
+
+func (d *socketDevice) Close() error {
+	return d.pc.Close()
+}
+
+const (
+	// The largest IP packet.
+	maxPacketLen = 65535
+
+	reconnectDelay = 5 * time.Second
+)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openTUN opens or creates the TUN device with the given name. Each read and write is a single IP packet.
+func openTUN(name string) (io.ReadWriteCloser, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// struct ifreq with the interface name and flags.
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF", errno)
+	}
+
+	// Use the runtime poller, so that closing the device interrupts pending reads.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
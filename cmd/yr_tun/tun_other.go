@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openTUN returns an error, as TUN devices are only supported on Linux.
+func openTUN(string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN devices are only supported on Linux; use -socket instead")
+}
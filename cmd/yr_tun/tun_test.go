@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+func TestSocketTunnel(t *testing.T) {
+	rs, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect a client and a server.
+	clientPipe, serverPipe := net.Pipe()
+	errs := make(chan error, 1)
+	var server *yrgourd.Conn
+	go func() {
+		var err error
+		server, err = yrgourd.Respond(serverPipe, rs, rand.Reader, nil, yrgourd.AllowAllPolicy)
+		errs <- err
+	}()
+	client, err := yrgourd.Initiate(clientPipe, is, rs.PublicKey(), rand.Reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Give each side a socket device and a program which exchanges packets with it.
+	clientDev, clientHost := socketPair(t)
+	serverDev, serverHost := socketPair(t)
+
+	// The server's device only replies once its program has sent it something.
+	if _, err := serverHost.WriteTo([]byte("hello"), serverDev.pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverDev.Read(make([]byte, maxPacketLen)); err != nil {
+		t.Fatal(err)
+	}
+
+	clientRouter, serverRouter := new(router), new(router)
+	clientRouter.set(client)
+	go clientRouter.forward(clientDev)
+	go tunnel(serverDev, serverRouter, server)
+
+	// A packet sent to the client's device comes out of the server's.
+	packet := []byte("not really an IP packet")
+	if _, err := clientHost.WriteTo(packet, clientDev.pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxPacketLen)
+	if err := serverHost.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := serverHost.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(packet, buf[:n]) {
+		t.Errorf("expected %q but was %q", packet, buf[:n])
+	}
+}
+
+func TestSocketDeviceDropsWithoutPeer(t *testing.T) {
+	dev, _ := socketPair(t)
+
+	// Packets written before anything has sent one to the socket are dropped.
+	if n, err := dev.Write([]byte("packet")); err != nil || n != 6 {
+		t.Errorf("expected the packet to be dropped but was %d, %v", n, err)
+	}
+}
+
+// socketPair returns a socket device and a UDP socket for the program which uses it. The device isn't closed, as
+// router.forward exits the process if it fails to read.
+func socketPair(t *testing.T) (*socketDevice, net.PacketConn) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = host.Close()
+	})
+
+	return &socketDevice{pc: pc}, host
+}
@@ -0,0 +1,504 @@
+package yrgourd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+// ErrHandshakeTimeout is returned by NewPacketConn if the remote peer stops responding during the handshake.
+var ErrHandshakeTimeout = errors.New("yrgourd: handshake timed out")
+
+// MaxDatagramLen is the largest payload, in bytes, which can be sent in a single datagram.
+const MaxDatagramLen = maxDatagramSize - datagramOverhead
+
+// A PacketConn is an encrypted, authenticated datagram connection established by NewPacketConn. Unlike a Conn, each
+// datagram is sealed independently with a per-packet counter, so lost, duplicated, or reordered datagrams don't affect
+// the rest of the connection. Replayed datagrams are discarded, as are datagrams which are too old to be checked against
+// the replay window.
+//
+// The keys for each direction are derived once from the handshake and used for the PacketConn's entire lifetime, so
+// there is no forward secrecy within it: anyone who later learns its keys can decrypt every datagram it carried.
+// Long-lived associations should be replaced with a new handshake periodically, as often as a Conn would be ratcheted
+// (see Config.RatchetAfterTime), and a PacketConn must not send more than 2^64 datagrams.
+//
+// A PacketConn doesn't ratchet, send keepalives, pad, or shape traffic.
+type PacketConn struct {
+	pc       net.PacketConn
+	addr     net.Addr
+	conn     *Conn
+	hs       *datagramHandshake
+	sendKeys datagramKeys
+	recvKeys datagramKeys
+	counter  atomic.Uint64
+
+	readMu  sync.Mutex
+	readBuf []byte
+	pending []byte
+	replay  replayWindow
+}
+
+// NewPacketConn performs a handshake with the remote peer at addr over pc and returns a PacketConn for exchanging
+// datagrams with it. The handshake is performed by calling handshake with an io.ReadWriter which sends each flight of
+// the handshake as a single datagram, so any of Initiate, InitiateAnonymous, InitiateAny, Respond, or RespondKeys may
+// be used with the same keys, configuration, and policies as a stream connection. Lost flights are retransmitted.
+//
+// If addr is nil, the remote peer's address is taken from the first datagram received, which is suitable for a
+// responder. Datagrams from other addresses are ignored, so a PacketConn serves exactly one remote peer: pc isn't
+// demultiplexed by address, and a responder for many peers needs a net.PacketConn per peer (e.g. a connected UDP
+// socket for each). NewPacketConn uses pc's read deadline during the handshake.
+//
+// The peer which sent the final flight of the handshake (the responder, unless the handshake is hybrid) waits for a
+// datagram from the remote peer to confirm that it arrived. The remote peer sends an empty datagram once its handshake
+// completes, and responds to retransmissions of the final flight while reading, but any datagram it writes will do.
+//
+// Shaping should not be configured for the handshake, as cover frames sent before the handshake returns would be
+// included in its final flight.
+func NewPacketConn(pc net.PacketConn, addr net.Addr, handshake func(rw io.ReadWriter) (*Conn, error)) (*PacketConn, error) {
+	defer func() {
+		_ = pc.SetReadDeadline(time.Time{})
+	}()
+
+	hs := &datagramHandshake{pc: pc, addr: addr, buf: make([]byte, maxDatagramSize)}
+	conn, err := handshake(hs)
+	if err != nil {
+		return nil, err
+	}
+	conn.stopBackground()
+
+	// Send the final flight of the handshake, if it ended with a write.
+	if err := hs.flush(); err != nil {
+		return nil, err
+	}
+
+	p := &PacketConn{
+		pc:      pc,
+		addr:    hs.addr,
+		conn:    conn,
+		hs:      hs,
+		readBuf: hs.buf,
+	}
+	p.sendKeys, p.recvKeys = datagramTrafficKeys(conn)
+
+	// If the handshake ended with us reading the remote peer's final flight, confirm it with an empty datagram, which
+	// is retransmitted if the remote peer retransmits its final flight. Otherwise, wait for the remote peer to confirm
+	// our final flight, retransmitting it as needed.
+	if hs.readLast {
+		hs.last = p.seal(nil, nil)
+		if _, err := pc.WriteTo(hs.last, p.addr); err != nil {
+			return nil, err
+		}
+	} else if err := p.confirm(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Read reads the payload of the next datagram from the remote peer into b. If b is too small, the payload is truncated
+// and io.ErrShortBuffer is returned.
+func (p *PacketConn) Read(b []byte) (int, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	payload := p.pending
+	p.pending = nil
+	if payload == nil {
+		var err error
+		if payload, err = p.readPacket(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, payload)
+	if n < len(payload) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// Write seals b and sends it to the remote peer as a single datagram. b may be at most MaxDatagramLen bytes long.
+func (p *PacketConn) Write(b []byte) (int, error) {
+	if len(b) > MaxDatagramLen {
+		return 0, ErrMessageTooLarge
+	}
+
+	if _, err := p.pc.WriteTo(p.seal(nil, b), p.addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying net.PacketConn.
+func (p *PacketConn) Close() error {
+	return p.pc.Close()
+}
+
+// LocalAddr returns the local network address.
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.pc.LocalAddr()
+}
+
+// RemoteAddr returns the remote peer's network address.
+func (p *PacketConn) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+// SetDeadline sets the read and write deadlines of the underlying net.PacketConn.
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	return p.pc.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying net.PacketConn.
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	return p.pc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying net.PacketConn.
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return p.pc.SetWriteDeadline(t)
+}
+
+// LocalKey returns the static public key used by the local peer, or nil if the local peer is an anonymous initiator.
+func (p *PacketConn) LocalKey() *PublicKey {
+	return p.conn.LocalKey()
+}
+
+// RemoteKey returns the static public key of the remote peer, or nil if the remote peer is an anonymous initiator.
+func (p *PacketConn) RemoteKey() *PublicKey {
+	return p.conn.RemoteKey()
+}
+
+// ConnectionState returns the parameters negotiated during the handshake.
+func (p *PacketConn) ConnectionState() ConnectionState {
+	return p.conn.ConnectionState()
+}
+
+// ExportKeyingMaterial returns keying material derived from the handshake. See Conn.ExportKeyingMaterial.
+func (p *PacketConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	return p.conn.ExportKeyingMaterial(label, context, length)
+}
+
+// ChannelBinding returns a 32-byte value which uniquely identifies the connection. See Conn.ChannelBinding.
+func (p *PacketConn) ChannelBinding() []byte {
+	return p.conn.ChannelBinding()
+}
+
+// confirm waits for the first datagram from the remote peer, retransmitting the final flight of the handshake until it
+// arrives.
+func (p *PacketConn) confirm() error {
+	return p.hs.retransmit(func() error {
+		payload, err := p.readPacket()
+		if err != nil {
+			return err
+		}
+
+		// Keep any data the remote peer sent before its confirmation arrived.
+		if len(payload) > 0 {
+			p.pending = bytes.Clone(payload)
+		}
+		return nil
+	})
+}
+
+// readPacket reads datagrams until one from the remote peer is successfully opened, and returns its payload. The
+// payload is only valid until the next call to readPacket.
+func (p *PacketConn) readPacket() ([]byte, error) {
+	for {
+		n, addr, err := p.pc.ReadFrom(p.readBuf)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sameAddr(addr, p.addr) {
+			continue
+		}
+
+		// If the remote peer retransmitted its final flight of the handshake, our final flight was lost.
+		if p.hs.retransmitted(p.readBuf[:n]) {
+			if _, err := p.pc.WriteTo(p.hs.last, p.addr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Silently discard invalid and replayed datagrams.
+		if payload, ok := p.open(p.readBuf[:n]); ok {
+			return payload, nil
+		}
+	}
+}
+
+// seal appends a datagram with the next counter and the sealed payload to dst.
+func (p *PacketConn) seal(dst, payload []byte) []byte {
+	counter := p.counter.Add(1) - 1
+	start := len(dst)
+
+	// Seal the payload with a protocol keyed with the counter.
+	dst = binary.BigEndian.AppendUint64(dst, counter)
+	yr := p.sendKeys.protocol(dst[start:])
+	dst = yr.Seal("message", dst, payload)
+
+	// Mask the counter so that datagrams are indistinguishable from random noise.
+	p.sendKeys.maskCounter(dst[start:start+datagramCounterLen], dst[len(dst)-lockstitch.TagLen:])
+	return dst
+}
+
+// open opens a datagram in place, returning its payload if it is authentic and hasn't been received before.
+func (p *PacketConn) open(datagram []byte) ([]byte, bool) {
+	if len(datagram) < datagramOverhead {
+		return nil, false
+	}
+
+	// Unmask the counter and check it against the replay window before doing anything else.
+	header, ciphertext := datagram[:datagramCounterLen], datagram[datagramCounterLen:]
+	p.recvKeys.maskCounter(header, ciphertext[len(ciphertext)-lockstitch.TagLen:])
+	counter := binary.BigEndian.Uint64(header)
+	if !p.replay.check(counter) {
+		return nil, false
+	}
+
+	yr := p.recvKeys.protocol(header)
+	payload, err := yr.Open("message", ciphertext[:0], ciphertext)
+	if err != nil {
+		return nil, false
+	}
+	p.replay.accept(counter)
+	return payload, true
+}
+
+// stopBackground stops the connection's background goroutines without sending anything, so the connection's keys can be
+// used for datagrams instead.
+func (c *Conn) stopBackground() {
+	if c.keepalive != nil {
+		c.keepalive.stop()
+	}
+	if c.ratchetTimer != nil {
+		c.ratchetTimer.stop()
+	}
+	if c.shaper != nil {
+		c.shaper.stop()
+	}
+}
+
+// datagramKeys are the keys for datagrams sent in one direction.
+type datagramKeys struct {
+	key, maskKey []byte
+}
+
+// datagramTrafficKeys derives the keys for datagrams sent and received by the local peer from a completed handshake.
+func datagramTrafficKeys(c *Conn) (send, recv datagramKeys) {
+	yr := lockstitch.NewProtocol("yrgourd.datagram")
+	yr.Mix("secret", c.exporterSecret)
+	initiator := datagramKeys{key: yr.Derive("initiator", nil, 32), maskKey: yr.Derive("initiator-mask", nil, 32)}
+	responder := datagramKeys{key: yr.Derive("responder", nil, 32), maskKey: yr.Derive("responder-mask", nil, 32)}
+	if c.initiator {
+		return initiator, responder
+	}
+	return responder, initiator
+}
+
+// protocol returns a protocol for sealing or opening the datagram with the given encoded counter.
+func (k *datagramKeys) protocol(counter []byte) lockstitch.Protocol {
+	yr := lockstitch.NewProtocol("yrgourd.datagram.message")
+	yr.Mix("key", k.key)
+	yr.Mix("counter", counter)
+	return yr
+}
+
+// maskCounter masks or unmasks the encoded counter of a datagram with a mask derived from the datagram's tag.
+func (k *datagramKeys) maskCounter(counter, tag []byte) {
+	yr := lockstitch.NewProtocol("yrgourd.datagram.mask")
+	yr.Mix("key", k.maskKey)
+	yr.Mix("tag", tag)
+	mask := yr.Derive("mask", nil, datagramCounterLen)
+	for i := range counter {
+		counter[i] ^= mask[i]
+	}
+}
+
+// A replayWindow tracks which of the most recent counters have been received, in the style of RFC 6479.
+type replayWindow struct {
+	next   uint64 // one more than the highest counter received
+	bitmap [replayWindowLen / 64]uint64
+}
+
+// check returns false if the counter has already been received or is too old to tell.
+func (w *replayWindow) check(counter uint64) bool {
+	if counter >= w.next {
+		return true
+	}
+
+	if w.next > replayWindowLen && counter < w.next-replayWindowLen {
+		return false
+	}
+
+	i := counter % replayWindowLen
+	return w.bitmap[i/64]&(1<<(i%64)) == 0
+}
+
+// accept records that the counter has been received.
+func (w *replayWindow) accept(counter uint64) {
+	if counter >= w.next {
+		// Forget the counters which have fallen out of the window.
+		if counter-w.next >= replayWindowLen {
+			clear(w.bitmap[:])
+		} else {
+			for c := w.next; c <= counter; c++ {
+				i := c % replayWindowLen
+				w.bitmap[i/64] &^= 1 << (i % 64)
+			}
+		}
+		w.next = counter + 1
+	}
+
+	i := counter % replayWindowLen
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+// datagramHandshake is an io.ReadWriter which carries a handshake over datagrams. Everything written between reads is
+// sent as a single datagram (a flight), and each read is served from the most recent datagram received. If the remote
+// peer doesn't respond to a flight, it is retransmitted; if the remote peer retransmits its previous flight, our
+// response to it was lost, and it is retransmitted as well.
+type datagramHandshake struct {
+	pc       net.PacketConn
+	addr     net.Addr
+	buf      []byte
+	mu       sync.Mutex
+	out      []byte // the flight being written
+	last     []byte // the last flight sent
+	in       []byte // the unread part of the last flight received
+	received []byte // the last flight received
+	readLast bool   // whether the last operation was a read
+}
+
+func (h *datagramHandshake) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.out = append(h.out, p...)
+	h.readLast = false
+	return len(p), nil
+}
+
+func (h *datagramHandshake) Read(p []byte) (int, error) {
+	if len(h.in) == 0 {
+		if err := h.flush(); err != nil {
+			return 0, err
+		}
+
+		if err := h.retransmit(h.receive); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, h.in)
+	h.in = h.in[n:]
+	h.readLast = true
+	return n, nil
+}
+
+// SetReadDeadline sets the read deadline of the underlying net.PacketConn, which allows ProbeResistance to stop
+// discarding datagrams.
+func (h *datagramHandshake) SetReadDeadline(t time.Time) error {
+	return h.pc.SetReadDeadline(t)
+}
+
+// flush sends the flight being written, if any.
+func (h *datagramHandshake) flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.out) == 0 {
+		return nil
+	}
+
+	h.last, h.out = h.out, nil
+	_, err := h.pc.WriteTo(h.last, h.addr)
+	return err
+}
+
+// receive waits for a new flight from the remote peer.
+func (h *datagramHandshake) receive() error {
+	for {
+		n, addr, err := h.pc.ReadFrom(h.buf)
+		if err != nil {
+			return err
+		}
+
+		// Take the remote peer's address from the first datagram, if it isn't known.
+		if h.addr == nil {
+			h.addr = addr
+		} else if !sameAddr(addr, h.addr) {
+			continue
+		}
+
+		// If the remote peer retransmitted its previous flight, our response to it was lost.
+		if h.retransmitted(h.buf[:n]) {
+			if _, err := h.pc.WriteTo(h.last, h.addr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.received = bytes.Clone(h.buf[:n])
+		h.in = h.received
+		return nil
+	}
+}
+
+// retransmitted returns true if the datagram is a retransmission of the last flight received from the remote peer.
+func (h *datagramHandshake) retransmitted(datagram []byte) bool {
+	return h.received != nil && h.last != nil && bytes.Equal(datagram, h.received)
+}
+
+// retransmit calls f, retransmitting the last flight sent each time f times out. If no flight has been sent, f is
+// called without a timeout.
+func (h *datagramHandshake) retransmit(f func() error) error {
+	if h.last == nil {
+		return f()
+	}
+
+	timeout := handshakeRetransmitTime
+	for range handshakeRetransmits {
+		if err := h.pc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+
+		err := f()
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+
+		if _, err := h.pc.WriteTo(h.last, h.addr); err != nil {
+			return err
+		}
+		timeout *= 2
+	}
+	return ErrHandshakeTimeout
+}
+
+// sameAddr returns true if the two addresses are the same.
+func sameAddr(a, b net.Addr) bool {
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+const (
+	datagramCounterLen = 8
+	datagramOverhead   = datagramCounterLen + lockstitch.TagLen
+
+	// The largest UDP payload over IPv4.
+	maxDatagramSize = 65507
+
+	replayWindowLen = 2048
+
+	handshakeRetransmitTime = 250 * time.Millisecond
+	handshakeRetransmits    = 6
+)
@@ -0,0 +1,243 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketConn(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config *Config
+		loss   func(pc *lossyPacketConn)
+		early  string
+	}{
+		{name: "reliable"},
+		{name: "hybrid", config: &Config{Hybrid: true}},
+		{name: "lost request", loss: func(pc *lossyPacketConn) { pc.drop = 1 }},
+		{name: "lost confirmation", loss: func(pc *lossyPacketConn) { pc.skip, pc.drop = 1, 1 }, early: "zero"},
+		{name: "lost hybrid ciphertext", config: &Config{Hybrid: true}, loss: func(pc *lossyPacketConn) { pc.skip, pc.drop = 1, 1 }},
+		{name: "duplicated", loss: func(pc *lossyPacketConn) { pc.duplicate = true }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := testPacketConnPair(t, tc.config, tc.loss, tc.early)
+
+			if !client.RemoteKey().Equal(server.LocalKey()) || !server.RemoteKey().Equal(client.LocalKey()) {
+				t.Error("key mismatch")
+			}
+
+			if !bytes.Equal(client.ChannelBinding(), server.ChannelBinding()) {
+				t.Error("channel binding mismatch")
+			}
+
+			// Data sent by the client as soon as its handshake completes confirms the server's handshake.
+			if tc.early != "" {
+				buf := make([]byte, 100)
+				n, err := server.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if expected, actual := tc.early, string(buf[:n]); expected != actual {
+					t.Errorf("expected %q but was %q", expected, actual)
+				}
+			}
+
+			// Datagrams are delivered once each, in both directions.
+			for _, pair := range [][2]*PacketConn{{client, server}, {server, client}} {
+				for _, message := range []string{"one", "two", "three"} {
+					if _, err := pair[0].Write([]byte(message)); err != nil {
+						t.Fatal(err)
+					}
+
+					buf := make([]byte, 100)
+					n, err := pair[1].Read(buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if expected, actual := message, string(buf[:n]); expected != actual {
+						t.Errorf("expected %q but was %q", expected, actual)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPacketConnShortBuffer(t *testing.T) {
+	client, server := testPacketConnPair(t, nil, nil, "")
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2)
+	if n, err := server.Read(buf); !errors.Is(err, io.ErrShortBuffer) || n != 2 {
+		t.Errorf("expected (2, %v) but was (%d, %v)", io.ErrShortBuffer, n, err)
+	}
+
+	if _, err := client.Write(make([]byte, MaxDatagramLen+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected %v but was %v", ErrMessageTooLarge, err)
+	}
+}
+
+func TestPacketConnPolicy(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPC, serverPC := testUDPPair(t)
+	_ = clientPC.SetDeadline(time.Now().Add(time.Second))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewPacketConn(serverPC, nil, func(rw io.ReadWriter) (*Conn, error) {
+			return Respond(rw, rs, rand.Reader, nil, func(*PublicKey, []byte) bool { return false })
+		})
+		errs <- err
+	}()
+
+	if _, err := NewPacketConn(clientPC, serverPC.LocalAddr(), func(rw io.ReadWriter) (*Conn, error) {
+		return Initiate(rw, is, rs.PublicKey(), rand.Reader, nil)
+	}); err == nil {
+		t.Error("expected the client handshake to fail")
+	}
+
+	if err := <-errs; !errors.Is(err, ErrInitiatorNotAllowed) {
+		t.Errorf("expected %v but was %v", ErrInitiatorNotAllowed, err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		counter  uint64
+		expected bool
+	}{
+		{0, true},
+		{0, false},
+		{2, true},
+		{1, true},
+		{2, false},
+		{replayWindowLen + 10, true},
+		{5, false},
+		{11, true},
+		{11, false},
+		{10 * replayWindowLen, true},
+		{9 * replayWindowLen, false},
+		{10*replayWindowLen - 1, true},
+	} {
+		if actual := w.check(tc.counter); actual != tc.expected {
+			t.Errorf("expected check(%d) to be %v but was %v", tc.counter, tc.expected, actual)
+		}
+		if tc.expected {
+			w.accept(tc.counter)
+		}
+	}
+}
+
+func testPacketConnPair(t *testing.T, config *Config, loss func(pc *lossyPacketConn), early string) (client, server *PacketConn) {
+	t.Helper()
+
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientUDP, serverUDP := testUDPPair(t)
+	clientPC := &lossyPacketConn{PacketConn: clientUDP}
+	if loss != nil {
+		loss(clientPC)
+	}
+
+	var clientErr, serverErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		client, clientErr = NewPacketConn(clientPC, serverUDP.LocalAddr(), func(rw io.ReadWriter) (*Conn, error) {
+			return Initiate(rw, is, rs.PublicKey(), rand.Reader, config)
+		})
+		if clientErr == nil && early != "" {
+			_, clientErr = client.Write([]byte(early))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		server, serverErr = NewPacketConn(serverUDP, nil, func(rw io.ReadWriter) (*Conn, error) {
+			return Respond(rw, rs, rand.Reader, config, AllowAllPolicy)
+		})
+	}()
+	wg.Wait()
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+	}
+
+	for _, pc := range []*PacketConn{client, server} {
+		if err := pc.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client, server
+}
+
+func testUDPPair(t *testing.T) (client, server net.PacketConn) {
+	t.Helper()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// lossyPacketConn drops or duplicates datagrams written to it.
+type lossyPacketConn struct {
+	net.PacketConn
+	skip, drop int  // the number of datagrams to send before dropping, and the number to drop
+	duplicate  bool // whether to send every datagram twice
+}
+
+func (pc *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if pc.skip > 0 {
+		pc.skip--
+	} else if pc.drop > 0 {
+		pc.drop--
+		return len(p), nil
+	}
+
+	if pc.duplicate {
+		if _, err := pc.PacketConn.WriteTo(p, addr); err != nil {
+			return 0, err
+		}
+	}
+	return pc.PacketConn.WriteTo(p, addr)
+}
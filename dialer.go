@@ -0,0 +1,117 @@
+package yrgourd
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Dialer establishes yrgourd connections over a network.
+type Dialer struct {
+	// Key is the initiator's static private key. If nil, the dialer initiates anonymously (see InitiateAnonymous), which
+	// requires the responder's key to be known in advance.
+	Key *PrivateKey
+
+	// ServerKey is the responder's static public key. If nil, the responder's key is looked up in or learned via
+	// KnownHosts.
+	ServerKey *PublicKey
+
+	// KnownHosts is used to verify responders when ServerKey is nil. Responders with pinned keys are connected to
+	// directly, so a responder whose key has changed fails the handshake. Responders without pinned keys are verified
+	// by discovering their keys (see InitiateAny), so they must set Config.AllowDiscovery.
+	KnownHosts *KnownHosts
+
+	// Config is passed to the handshake. If nil, DefaultConfig is used.
+	Config *Config
+
+	// Rand is the source of randomness for the handshake. If nil, crypto/rand.Reader is used.
+	Rand io.Reader
+
+	// NetDialer is used to establish the underlying connection.
+	NetDialer net.Dialer
+}
+
+var ErrNoServerKey = errors.New("yrgourd: dialer has neither a server key nor known hosts")
+
+// Dial connects to the address on the named network and performs a handshake.
+func (d *Dialer) Dial(network, address string) (*Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network and performs a handshake using the provided context.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*Conn, error) {
+	random := d.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+
+	// Figure out which key we expect the responder to have, if any.
+	rs := d.ServerKey
+	if rs == nil {
+		if d.KnownHosts == nil {
+			return nil, ErrNoServerKey
+		}
+
+		rs = d.KnownHosts.Lookup(address)
+		if rs == nil && d.KnownHosts.Mode == StrictHostKeys {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownHost, address)
+		}
+	}
+
+	// Anonymous initiators can't discover the responder's key.
+	if d.Key == nil && rs == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHost, address)
+	}
+
+	// If the responder rejected our resumption ticket, the ticket is gone and we can retry with a full handshake.
+	conn, err := d.dial(ctx, network, address, rs, random)
+	if errors.Is(err, ErrTicketRejected) {
+		conn, err = d.dial(ctx, network, address, rs, random)
+	}
+	return conn, err
+}
+
+// dial connects to the address on the named network and performs a handshake with the responder, whose static public
+// key is discovered if rs is nil.
+func (d *Dialer) dial(ctx context.Context, network, address string, rs *PublicKey, random io.Reader) (*Conn, error) {
+	conn, err := d.NetDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the handshake by the context's deadline and abort it if the context is cancelled.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	// Only hosts without pinned keys are verified via discovery.
+	var yrConn *Conn
+	switch {
+	case d.Key == nil:
+		yrConn, err = InitiateAnonymous(conn, rs, random, d.Config)
+	case rs != nil:
+		yrConn, err = Initiate(conn, d.Key, rs, random, d.Config)
+	default:
+		yrConn, err = initiateDiscover(conn, d.Key, random, d.Config, func(rs *PublicKey) error {
+			return d.KnownHosts.Verify(address, rs)
+		})
+	}
+
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return yrConn, nil
+}
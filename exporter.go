@@ -0,0 +1,61 @@
+package yrgourd
+
+import (
+	"errors"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+var ErrInvalidLength = errors.New("yrgourd: invalid keying material length")
+
+// ExportKeyingMaterial returns length bytes of keying material derived from the connection's handshake, the label, and
+// the context, similar to RFC 5705. Both peers derive the same keying material for the same label and context, and
+// different labels or contexts produce independent keying material. Labels should be specific to the application.
+// Returns ErrInvalidLength if length is negative or greater than MaxKeyingMaterialLen.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if length < 0 || length > MaxKeyingMaterialLen {
+		return nil, ErrInvalidLength
+	}
+
+	yr := lockstitch.NewProtocol("yrgourd.exporter")
+	yr.Mix("secret", c.exporterSecret)
+	yr.Mix("label", []byte(label))
+	yr.Mix("context", context)
+	return yr.Derive("output", nil, length), nil
+}
+
+// ChannelBinding returns a 32-byte value which uniquely identifies the connection. Both peers have the same value for a
+// connection, and it does not change when the connection is ratcheted. Applications can bind their own authentication
+// to the connection by, e.g., signing the channel binding value.
+func (c *Conn) ChannelBinding() []byte {
+	return c.channelBinding
+}
+
+// exportSecrets derives the exporter secret, the channel binding value, and the resumption secret from the protocol of a
+// completed handshake.
+func exportSecrets(yr *lockstitch.Protocol) (exporterSecret, channelBinding, resumptionSecret []byte) {
+	exporterSecret = yr.Derive("exporter", nil, 32)
+	channelBinding = yr.Derive("channel-binding", nil, channelBindingLen)
+	resumptionSecret = yr.Derive("resumption", nil, resumptionSecretLen)
+	return exporterSecret, channelBinding, resumptionSecret
+}
+
+// fork splits the protocol of a completed handshake into independent protocols for traffic sent by the responder and
+// the initiator. Clone can't be used for this, as its copies share the same underlying state.
+func fork(yr *lockstitch.Protocol) (responder, initiator lockstitch.Protocol) {
+	responder = lockstitch.NewProtocol("yrgourd.traffic")
+	responder.Mix("key", yr.Derive("responder", nil, 32))
+	responder.Mix("sender", []byte("responder"))
+
+	initiator = lockstitch.NewProtocol("yrgourd.traffic")
+	initiator.Mix("key", yr.Derive("initiator", nil, 32))
+	initiator.Mix("sender", []byte("initiator"))
+
+	return responder, initiator
+}
+
+// MaxKeyingMaterialLen is the largest amount of keying material ExportKeyingMaterial returns, which is the same as the
+// limit of the TLS exporter's HKDF-SHA-256.
+const MaxKeyingMaterialLen = 255 * 32
+
+const channelBindingLen = 32
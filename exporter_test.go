@@ -0,0 +1,135 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestExportKeyingMaterial(t *testing.T) {
+	client, server := testConnPair(t, nil, nil)
+
+	if !bytes.Equal(client.ChannelBinding(), server.ChannelBinding()) {
+		t.Errorf("expected channel bindings to match but were %x/%x", client.ChannelBinding(), server.ChannelBinding())
+	}
+
+	a, err := client.ExportKeyingMaterial("test", []byte("context"), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := server.ExportKeyingMaterial("test", []byte("context"), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a, b) {
+		t.Errorf("expected exported keying material to match but was %x/%x", a, b)
+	}
+	if len(a) != 40 {
+		t.Errorf("expected 40 bytes but was %d", len(a))
+	}
+
+	if c, _ := client.ExportKeyingMaterial("other", []byte("context"), 40); bytes.Equal(a, c) {
+		t.Error("expected different labels to export different keying material")
+	}
+
+	if c, _ := client.ExportKeyingMaterial("test", []byte("other"), 40); bytes.Equal(a, c) {
+		t.Error("expected different contexts to export different keying material")
+	}
+
+	for _, length := range []int{-1, MaxKeyingMaterialLen + 1} {
+		if _, err := client.ExportKeyingMaterial("test", nil, length); !errors.Is(err, ErrInvalidLength) {
+			t.Errorf("length %d: expected %v but was %v", length, ErrInvalidLength, err)
+		}
+	}
+
+	if b, err := client.ExportKeyingMaterial("test", nil, MaxKeyingMaterialLen); err != nil || len(b) != MaxKeyingMaterialLen {
+		t.Errorf("expected %d bytes but was %d (%v)", MaxKeyingMaterialLen, len(b), err)
+	}
+
+	other, _ := testConnPair(t, nil, nil)
+	if bytes.Equal(client.ChannelBinding(), other.ChannelBinding()) {
+		t.Error("expected different connections to have different channel bindings")
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	client, server := testConnPair(t, nil, nil)
+
+	// Both peers write and read at the same time, which requires independent send and recv states.
+	message := make([]byte, 64*1024)
+	if _, err := rand.Read(message); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, conn := range []*Conn{client, server} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < len(message); i += 1024 {
+				if _, err := conn.Write(message[i : i+1024]); err != nil {
+					t.Errorf("write error: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+
+			actual := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, actual); err != nil {
+				t.Errorf("read error: %v", err)
+				return
+			}
+			if !bytes.Equal(message, actual) {
+				t.Error("message mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// testConnPair returns an initiator and a responder with new keys, connected with the given configurations.
+func testConnPair(t *testing.T, clientConfig, serverConfig *Config) (client, server *Conn) {
+	t.Helper()
+
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testConnect(t, is, rs, clientConfig, serverConfig)
+}
+
+// testConnect returns an initiator with the given static key, or an anonymous one if it's nil, connected to a responder
+// with the given static key, failing the test if the handshake fails.
+func testConnect(t *testing.T, is, rs *PrivateKey, clientConfig, serverConfig *Config) (client, server *Conn) {
+	t.Helper()
+
+	client, server, clientErr, serverErr := testHandshake(t,
+		func(rw io.ReadWriter) (*Conn, error) {
+			if is == nil {
+				return InitiateAnonymous(rw, rs.PublicKey(), rand.Reader, clientConfig)
+			}
+			return Initiate(rw, is, rs.PublicKey(), rand.Reader, clientConfig)
+		},
+		func(rw io.ReadWriter) (*Conn, error) {
+			return Respond(rw, rs, rand.Reader, serverConfig, AllowAllPolicy)
+		},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+	}
+	return client, server
+}
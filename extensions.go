@@ -0,0 +1,298 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"io"
+	mrand "math/rand/v2"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+// Both peers send an encrypted extension area during the handshake: the initiator before its static public key, and
+// the responder after all the Diffie-Hellman shared secrets have been mixed in. Because the extension area is sealed,
+// it is bound to the handshake transcript and cannot be modified by an attacker.
+//
+// The extension area consists of a fixed-size header, sealed with the label "ext":
+//
+//	version (1 byte) || features (4 bytes) || max frame size (4 bytes) || data length (2 bytes)
+//
+// If the data length is non-zero, the header is followed by that many bytes (plus a tag) of extension data, sealed with
+// the label "ext-data". The extension data is a sequence of type (1 byte) || length (2 bytes) || value entries, and
+// entries of unknown types are ignored. New handshake fields should be added as extension data entries and gated on a
+// feature flag, so that peers which don't support them can still interoperate.
+//
+// The initiator advertises the highest version and all the features it supports. The responder replies with the lower
+// of the two versions and the intersection of the two feature sets, which both peers then use for the connection.
+//
+// Version 1 is the original protocol, which had no extension area and used untyped frames. Its requests are recognized
+// by length and rejected with ErrUnsupportedVersion, so every request which may be rejected before the responder
+// reaches the initiator's static public key is padded to at least that length.
+
+// Features is a set of optional protocol features.
+type Features uint32
+
+const (
+	// FeatureCloseNotify indicates that a peer sends a close_notify frame when the connection is closed, allowing the
+	// other peer to distinguish a clean close from a truncated connection.
+	FeatureCloseNotify Features = 1 << iota
+
+	// FeaturePreSharedKey indicates that a peer has mixed a pre-shared key into the handshake.
+	FeaturePreSharedKey
+
+	// FeatureTickets indicates that a peer supports resumption tickets: the responder issues them and the initiator
+	// stores them.
+	FeatureTickets
+
+	// FeaturePadding indicates that a peer accepts padded frames.
+	FeaturePadding
+
+	// FeatureCoverTraffic indicates that a peer accepts cover frames, which it discards.
+	FeatureCoverTraffic
+
+	// FeatureKeepalive indicates that a peer answers ping frames.
+	FeatureKeepalive
+
+	// FeatureRekey indicates that a peer ratchets when asked to with a rekey request frame.
+	FeatureRekey
+
+	// FeatureEphemeralRatchet indicates that a peer ratchets with ephemeral keys on both sides, so that ratchets don't
+	// depend on the peers' static keys. Otherwise, each ratchet uses the receiver's static key.
+	FeatureEphemeralRatchet
+)
+
+// supportedFeatures is the set of features this implementation advertises.
+const supportedFeatures = FeatureCloseNotify | FeaturePadding | FeatureCoverTraffic | FeatureKeepalive | FeatureRekey |
+	FeatureEphemeralRatchet
+
+// extensions are the contents of a peer's extension area.
+type extensions struct {
+	version      uint8
+	features     Features
+	maxFrameSize int
+	data         map[uint8][]byte
+}
+
+// localExtensions returns the extensions this peer advertises given the configuration.
+func localExtensions(config *Config) *extensions {
+	features := supportedFeatures
+	if config.PreSharedKey != nil {
+		features |= FeaturePreSharedKey
+	}
+	if (config.TicketKeys != nil || config.SessionCache != nil) && !config.Hybrid {
+		features |= FeatureTickets
+	}
+
+	e := &extensions{
+		version:      protocolVersion,
+		features:     features,
+		maxFrameSize: maxFrameSize(config),
+	}
+
+	// If configured, pad the extension data to hide the handshake's size.
+	if pr := config.ProbeResistance; pr != nil && pr.MaxPadding > 0 {
+		e.set(extPadding, make([]byte, mrand.IntN(min(pr.MaxPadding, maxPadding)+1)))
+	}
+	return e
+}
+
+// negotiate returns the extensions a responder replies with given those of the initiator, keeping the responder's
+// extension data.
+func (e *extensions) negotiate(initiator *extensions) *extensions {
+	return &extensions{
+		version:      min(e.version, initiator.version),
+		features:     e.features & initiator.features,
+		maxFrameSize: e.maxFrameSize,
+		data:         e.data,
+	}
+}
+
+// seal appends the sealed extension header and extension data, if any, to dst.
+func (e *extensions) seal(yr *lockstitch.Protocol, dst []byte) []byte {
+	var data []byte
+	for t, v := range e.data {
+		data = append(data, t)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(v)))
+		data = append(data, v...)
+	}
+
+	header := make([]byte, 0, extHeaderLen)
+	header = append(header, e.version)
+	header = binary.BigEndian.AppendUint32(header, uint32(e.features))
+	header = binary.BigEndian.AppendUint32(header, uint32(e.maxFrameSize))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(data)))
+
+	dst = yr.Seal("ext", dst, header)
+	if len(data) > 0 {
+		dst = yr.Seal("ext-data", dst, data)
+	}
+	return dst
+}
+
+// padRequest pads the extension data so that the request is at least as long as a version 1 request, which lets a
+// responder read enough of any request to recognize one from a version 1 initiator.
+func (e *extensions) padRequest() {
+	if len(e.data[extPadding]) < minRequestPadding {
+		e.set(extPadding, make([]byte, minRequestPadding))
+	}
+}
+
+// set sets the extension data entry of the given type.
+func (e *extensions) set(t uint8, v []byte) {
+	if e.data == nil {
+		e.data = make(map[uint8][]byte)
+	}
+	e.data[t] = v
+}
+
+// readExtensions reads and opens a peer's extension area.
+func readExtensions(r io.Reader, yr *lockstitch.Protocol) (*extensions, error) {
+	header := make([]byte, extHeaderLen+lockstitch.TagLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	e, dataLen, err := openExtensionHeader(yr, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.readData(r, yr, dataLen); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// openExtensionHeader opens a sealed extension header, returning the extensions and the length of the extension data.
+func openExtensionHeader(yr *lockstitch.Protocol, b []byte) (*extensions, int, error) {
+	header, err := yr.Open("ext", nil, b)
+	if err != nil {
+		return nil, 0, ErrInvalidHandshake
+	}
+
+	e := &extensions{
+		version:      header[0],
+		features:     Features(binary.BigEndian.Uint32(header[1:])),
+		maxFrameSize: int(binary.BigEndian.Uint32(header[5:])),
+	}
+	if e.version < minProtocolVersion {
+		return nil, 0, ErrUnsupportedVersion
+	}
+	if e.maxFrameSize < minFrameSize || e.maxFrameSize > maxFrameLen {
+		return nil, 0, ErrInvalidHandshake
+	}
+	return e, int(binary.BigEndian.Uint16(header[9:])), nil
+}
+
+// readData reads, opens, and parses the extension data, if any.
+func (e *extensions) readData(r io.Reader, yr *lockstitch.Protocol, n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	data := make([]byte, n+lockstitch.TagLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	data, err := yr.Open("ext-data", data[:0], data)
+	if err != nil {
+		return ErrInvalidHandshake
+	}
+
+	e.data = make(map[uint8][]byte)
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return ErrInvalidHandshake
+		}
+
+		t, n := data[0], int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+n {
+			return ErrInvalidHandshake
+		}
+		e.data[t] = data[3 : 3+n]
+		data = data[3+n:]
+	}
+	return nil
+}
+
+// setAnonymous marks the initiator as anonymous.
+func (e *extensions) setAnonymous() {
+	e.set(extAnonymous, nil)
+}
+
+// anonymous returns true if the initiator is anonymous.
+func (e *extensions) anonymous() bool {
+	_, ok := e.data[extAnonymous]
+	return ok
+}
+
+// setRatchetKey sets the local peer's initial ratchet key.
+func (e *extensions) setRatchetKey(key *PublicKey) {
+	e.set(extRatchetKey, CompressPublicKey(key))
+}
+
+// ratchetKey returns the peer's initial ratchet key.
+func (e *extensions) ratchetKey() (*PublicKey, error) {
+	b, ok := e.data[extRatchetKey]
+	if !ok {
+		return nil, ErrInvalidHandshake
+	}
+
+	key, err := NewPublicKey(b)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	return key, nil
+}
+
+// maxFrameSize returns the largest frame payload the local peer will accept.
+func maxFrameSize(config *Config) int {
+	if config.MaxFrameSize <= 0 || config.MaxFrameSize > maxFrameLen {
+		return maxFrameLen
+	}
+	return max(config.MaxFrameSize, minFrameSize)
+}
+
+// checkReply returns an error if the responder's extensions aren't a valid reply to the initiator's: the responder may
+// not pick a higher version or add features the initiator didn't advertise.
+func (e *extensions) checkReply(reply *extensions) error {
+	if reply.version > e.version || reply.features&^e.features != 0 {
+		return ErrInvalidHandshake
+	}
+	return nil
+}
+
+// state returns the connection state for the negotiated extensions and the remote peer's extensions.
+func (e *extensions) state(peer *extensions, config *Config) ConnectionState {
+	return ConnectionState{
+		Version:      int(e.version),
+		Features:     e.features,
+		Hybrid:       config.Hybrid,
+		MaxFrameSize: peer.maxFrameSize,
+	}
+}
+
+const (
+	// protocolVersion is the highest protocol version this implementation supports.
+	protocolVersion = 2
+	// minProtocolVersion is the lowest protocol version this implementation supports.
+	minProtocolVersion = 2
+
+	// extPayloadLen is the extension data type for the length of the peer's early data or response data.
+	extPayloadLen = 1
+	// extTimestamp is the extension data type for the time at which the initiator sent its request.
+	extTimestamp = 2
+	// extAnonymous is the extension data type which marks the initiator as anonymous.
+	extAnonymous = 3
+	// extRatchetKey is the extension data type for the peer's initial ratchet key, in compressed form.
+	extRatchetKey = 4
+	// extPadding is the extension data type for padding, which is ignored.
+	extPadding = 5
+
+	// version + features + max frame size + data length
+	extHeaderLen = 1 + 4 + 4 + 2
+	// sealed extension header
+	extLen = extHeaderLen + lockstitch.TagLen
+	// v1ReqLen - (elligator(ie) + ext + data tag + padding type and length)
+	minRequestPadding = v1ReqLen - elligatorPointLen - extLen - lockstitch.TagLen - 3
+)
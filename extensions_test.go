@@ -0,0 +1,123 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+func TestConnectionState(t *testing.T) {
+	client, server := testConnPair(t, &Config{MaxFrameSize: 4096}, nil)
+
+	if expected, actual := (ConnectionState{
+		Version:      protocolVersion,
+		Features:     FeatureCloseNotify | FeaturePadding | FeatureCoverTraffic | FeatureKeepalive | FeatureRekey | FeatureEphemeralRatchet,
+		MaxFrameSize: maxFrameLen,
+	}), client.ConnectionState(); expected != actual {
+		t.Errorf("expected client state %+v but was %+v", expected, actual)
+	}
+
+	if expected, actual := (ConnectionState{
+		Version:      protocolVersion,
+		Features:     FeatureCloseNotify | FeaturePadding | FeatureCoverTraffic | FeatureKeepalive | FeatureRekey | FeatureEphemeralRatchet,
+		MaxFrameSize: 4096,
+	}), server.ConnectionState(); expected != actual {
+		t.Errorf("expected server state %+v but was %+v", expected, actual)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	client, server := testConnPair(t, nil, &Config{MaxFrameSize: minFrameSize})
+
+	message := make([]byte, 10*minFrameSize+7)
+	if _, err := rand.Read(message); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if _, err := client.Write(message); err != nil {
+			t.Errorf("client write error: %v", err)
+		}
+	}()
+
+	actual := make([]byte, len(message))
+	for i := 0; i < len(actual); {
+		n, err := server.Read(actual[i:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > minFrameSize {
+			t.Fatalf("read a %d-byte frame", n)
+		}
+		i += n
+	}
+
+	if !bytes.Equal(message, actual) {
+		t.Error("message mismatch")
+	}
+}
+
+func TestCloseNotify(t *testing.T) {
+	t.Run("clean", func(t *testing.T) {
+		client, server := testConnPair(t, nil, nil)
+
+		go func() {
+			_ = client.Close()
+		}()
+
+		for range 2 {
+			if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Errorf("expected %v but was %v", io.EOF, err)
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		client, server := testConnPair(t, nil, nil)
+
+		// Close the underlying connection without sending a close_notify frame.
+		_ = client.rw.(io.Closer).Close()
+
+		if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected %v but was %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+}
+
+func TestExtensionData(t *testing.T) {
+	sent := &extensions{
+		version:      protocolVersion,
+		features:     FeatureCloseNotify,
+		maxFrameSize: maxFrameLen,
+		data: map[uint8][]byte{
+			1:   []byte("one"),
+			200: bytes.Repeat([]byte{0xff}, 300),
+		},
+	}
+
+	a, b := lockstitch.NewProtocol("test"), lockstitch.NewProtocol("test")
+	received, err := readExtensions(bytes.NewReader(sent.seal(&a, nil)), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := sent.features, received.features; expected != actual {
+		t.Errorf("expected features %v but was %v", expected, actual)
+	}
+
+	for k, v := range sent.data {
+		if !bytes.Equal(v, received.data[k]) {
+			t.Errorf("expected data[%d] = %x but was %x", k, v, received.data[k])
+		}
+	}
+
+	c, d := lockstitch.NewProtocol("test"), lockstitch.NewProtocol("test")
+	sent.version = minProtocolVersion - 1
+	if _, err := readExtensions(bytes.NewReader(sent.seal(&c, nil)), &d); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected %v but was %v", ErrUnsupportedVersion, err)
+	}
+}
@@ -0,0 +1,84 @@
+package yrgourd
+
+import (
+	"encoding/base32"
+	"strings"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+// Fingerprint returns a short, human-comparable fingerprint of the public key (e.g.
+// "k3x8-6hyq-dt1m-9s4e-orwb-pz5c").
+//
+// The fingerprint is a 120-bit domain-separated hash of the uncompressed public key, encoded in z-base-32 and grouped
+// into blocks of four characters.
+func Fingerprint(key *PublicKey) string {
+	s := fingerprintEncoding.EncodeToString(fingerprintDigest(key)[:fingerprintLen])
+
+	var b strings.Builder
+	for i := 0; i < len(s); i += 4 {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(s[i : i+4])
+	}
+	return b.String()
+}
+
+// Randomart returns an OpenSSH-style "drunken bishop" visualization of the public key's fingerprint. It is meant to be
+// compared at a glance, not read.
+func Randomart(key *PublicKey) string {
+	const (
+		width   = 17
+		height  = 9
+		symbols = " .o+=*BOX@%&#/^"
+	)
+
+	var field [width][height]int
+	x, y := width/2, height/2
+	for _, b := range fingerprintDigest(key) {
+		for range 4 {
+			if b&1 == 0 {
+				x = max(x-1, 0)
+			} else {
+				x = min(x+1, width-1)
+			}
+			if b&2 == 0 {
+				y = max(y-1, 0)
+			} else {
+				y = min(y+1, height-1)
+			}
+			field[x][y] = min(field[x][y]+1, len(symbols)-1)
+			b >>= 2
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("+----[yrgourd]----+\n")
+	for row := range height {
+		b.WriteByte('|')
+		for col := range width {
+			switch {
+			case col == width/2 && row == height/2:
+				b.WriteByte('S')
+			case col == x && row == y:
+				b.WriteByte('E')
+			default:
+				b.WriteByte(symbols[field[col][row]])
+			}
+		}
+		b.WriteString("|\n")
+	}
+	b.WriteString("+-----------------+")
+	return b.String()
+}
+
+func fingerprintDigest(key *PublicKey) []byte {
+	fp := lockstitch.NewProtocol("yrgourd.fingerprint")
+	fp.Mix("key", key.Bytes())
+	return fp.Derive("digest", nil, 32)
+}
+
+const fingerprintLen = 15
+
+var fingerprintEncoding = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
@@ -0,0 +1,55 @@
+package yrgourd
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	a, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := Fingerprint(a.PublicKey())
+	if expected, actual := 29, len(fp); expected != actual {
+		t.Errorf("expected fingerprint length of %d but was %d (%s)", expected, actual, fp)
+	}
+
+	if expected, actual := fp, Fingerprint(a.PublicKey()); expected != actual {
+		t.Errorf("expected stable fingerprint %s but was %s", expected, actual)
+	}
+
+	if fp == Fingerprint(b.PublicKey()) {
+		t.Errorf("expected distinct keys to have distinct fingerprints but both were %s", fp)
+	}
+}
+
+func TestRandomart(t *testing.T) {
+	k, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	art := Randomart(k.PublicKey())
+	lines := strings.Split(art, "\n")
+	if expected, actual := 11, len(lines); expected != actual {
+		t.Fatalf("expected %d lines but was %d:\n%s", expected, actual, art)
+	}
+
+	for _, line := range lines {
+		if expected, actual := 19, len(line); expected != actual {
+			t.Errorf("expected line length of %d but was %d: %q", expected, actual, line)
+		}
+	}
+
+	if art != Randomart(k.PublicKey()) {
+		t.Error("expected stable randomart")
+	}
+}
@@ -19,10 +19,11 @@ func FuzzInitiate(f *testing.F) {
 		f.Fatal(err)
 	}
 
-	f.Add([]byte("some garbage"))
-	f.Fuzz(func(t *testing.T, a []byte) {
+	f.Add([]byte("some garbage"), false)
+	f.Add([]byte("some garbage"), true)
+	f.Fuzz(func(t *testing.T, a []byte, hybrid bool) {
 		b := bytes.NewBuffer(a)
-		conn, err := yrgourd.Initiate(b, is, rs.PublicKey(), rand.Reader, nil)
+		conn, err := yrgourd.Initiate(b, is, rs.PublicKey(), rand.Reader, &yrgourd.Config{Hybrid: hybrid})
 		if err == nil {
 			t.Errorf("should not have initiated but did: %v", conn)
 		}
@@ -35,10 +36,11 @@ func FuzzRespond(f *testing.F) {
 		f.Fatal(err)
 	}
 
-	f.Add([]byte("some garbage"))
-	f.Fuzz(func(t *testing.T, a []byte) {
+	f.Add([]byte("some garbage"), false)
+	f.Add([]byte("some garbage"), true)
+	f.Fuzz(func(t *testing.T, a []byte, hybrid bool) {
 		b := bytes.NewBuffer(a)
-		conn, err := yrgourd.Respond(b, rs, rand.Reader, nil, yrgourd.AllowAllPolicy)
+		conn, err := yrgourd.Respond(b, rs, rand.Reader, &yrgourd.Config{Hybrid: hybrid}, yrgourd.AllowAllPolicy)
 		if err == nil {
 			t.Errorf("should not have responded but did: %v", conn)
 		}
@@ -4,14 +4,33 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
+	"math"
 	"net"
+	"os"
+	"slices"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/codahale/elligator-squared-p256"
+	"github.com/codahale/lockstitch-go"
 )
 
 func TestRoundTrip(t *testing.T) {
+	hybrid := DefaultConfig
+	hybrid.Hybrid = true
+
+	t.Run("standard", func(t *testing.T) {
+		testRoundTrip(t, &DefaultConfig)
+	})
+	t.Run("hybrid", func(t *testing.T) {
+		testRoundTrip(t, &hybrid)
+	})
+}
+
+func testRoundTrip(t *testing.T, config *Config) {
 	rs, err := GenerateKey(rand.Reader)
 	if err != nil {
 		t.Fatal(err)
@@ -26,7 +45,7 @@ func TestRoundTrip(t *testing.T) {
 		defer wg.Done()
 
 		t.Log("server responding")
-		rw, err := Respond(server, rs, rand.Reader, nil, AllowAllPolicy)
+		rw, err := Respond(server, rs, rand.Reader, config, AllowAllPolicy)
 		if err != nil {
 			t.Error("respond error:", err)
 		}
@@ -63,7 +82,7 @@ func TestRoundTrip(t *testing.T) {
 		}
 
 		t.Log("client initiating")
-		rw, err := Initiate(client, is, rs.PublicKey(), rand.Reader, nil)
+		rw, err := Initiate(client, is, rs.PublicKey(), rand.Reader, config)
 		if err != nil {
 			t.Error("initiate error:", err)
 		}
@@ -159,6 +178,110 @@ func TestRatcheting(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMessages(t *testing.T) {
+	client, server := testConnPair(t, nil, nil)
+
+	messages := [][]byte{[]byte("one"), []byte("two"), bytes.Repeat([]byte{0xff}, client.MaxMessageSize())}
+	errs := make(chan error, 1)
+	go func() {
+		for _, msg := range messages {
+			if err := client.WriteMessage(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- client.WriteMessage(make([]byte, client.MaxMessageSize()+1))
+	}()
+
+	// Message boundaries are preserved.
+	for _, expected := range messages {
+		actual, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("expected %d-byte message but was %d bytes", len(expected), len(actual))
+		}
+	}
+
+	if err := <-errs; !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected %v but was %v", ErrMessageTooLarge, err)
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	client, server := testConnPair(t, nil, nil)
+
+	// The client ratchets and asks the server to ratchet, then sends a message.
+	errs := make(chan error, 1)
+	go func() {
+		if err := client.Ratchet(); err != nil {
+			errs <- err
+			return
+		}
+		_, err := client.Write([]byte("ping"))
+		errs <- err
+	}()
+
+	// The server reads the ratchet frame, the rekey request, and the message.
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// The server ratchets in the background in response to the rekey request, so its ratchet frame may arrive before or
+	// after its replies. The client reads replies until it has received the ratchet frame as well.
+	for replies := int64(1); ; replies++ {
+		go func() {
+			_, err := server.Write([]byte("pong"))
+			errs <- err
+		}()
+
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		if client.Stats().FramesReceived > replies {
+			break
+		} else if replies >= 100 {
+			t.Fatal("expected the server to ratchet")
+		}
+	}
+
+	if got, want := server.Stats().FramesReceived, int64(3); got != want {
+		t.Errorf("expected server to receive %d frames but was %d", want, got)
+	}
+}
+
+func TestRatchetInBackground(t *testing.T) {
+	config := &Config{RatchetAfterBytes: math.MaxInt, RatchetAfterTime: 5 * time.Millisecond, RatchetInBackground: true}
+	client, server := testConnPair(t, config, nil)
+
+	// The client ratchets without writing anything.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(io.Discard, server)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if n := server.Stats().FramesReceived; n < 3 {
+		t.Errorf("expected at least 2 ratchet frames and a close_notify frame but was %d frames", n)
+	}
+}
+
 func TestHandshake(t *testing.T) {
 	rs, err := GenerateKey(rand.Reader)
 	if err != nil {
@@ -172,7 +295,7 @@ func TestHandshake(t *testing.T) {
 	if err := server.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
 		t.Fatal(err)
 	}
-	var clientConn, serverConn *connection
+	var clientConn, serverConn *Conn
 
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
@@ -184,7 +307,7 @@ func TestHandshake(t *testing.T) {
 			t.Error("respond error:", err)
 			return
 		}
-		serverConn = rw.(*connection)
+		serverConn = rw
 	}()
 	go func() {
 		defer wg.Done()
@@ -201,7 +324,7 @@ func TestHandshake(t *testing.T) {
 			return
 		}
 
-		clientConn = rw.(*connection)
+		clientConn = rw
 	}()
 	wg.Wait()
 
@@ -230,3 +353,560 @@ func TestHandshake(t *testing.T) {
 		t.Errorf("expected clientSend == serverRecv, but was %v/%v", clientSend, serverRecv)
 	}
 }
+
+func TestCompressedPublicKey(t *testing.T) {
+	for range 16 {
+		k, err := GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed := CompressPublicKey(k.PublicKey())
+		if expected, actual := 33, len(compressed); expected != actual {
+			t.Fatalf("expected compressed key length of %d but was %d", expected, actual)
+		}
+
+		pub, err := NewPublicKey(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !pub.Equal(k.PublicKey()) {
+			t.Errorf("expected %x but was %x", k.PublicKey().Bytes(), pub.Bytes())
+		}
+	}
+
+	if _, err := NewPublicKey(make([]byte, 33)); err == nil {
+		t.Error("should not have parsed an invalid compressed key")
+	}
+}
+
+func TestDiscoverHandshake(t *testing.T) {
+	config := DefaultConfig
+	config.AllowDiscovery = true
+	hybrid := config
+	hybrid.Hybrid = true
+
+	t.Run("standard", func(t *testing.T) {
+		testDiscoverHandshake(t, &config)
+	})
+	t.Run("hybrid", func(t *testing.T) {
+		testDiscoverHandshake(t, &hybrid)
+	})
+}
+
+func testDiscoverHandshake(t *testing.T, config *Config) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+	var clientConn, serverConn *Conn
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		rw, err := Respond(server, rs, rand.Reader, config, AllowAllPolicy)
+		if err != nil {
+			t.Error("respond error:", err)
+			return
+		}
+		serverConn = rw
+	}()
+	go func() {
+		defer wg.Done()
+
+		rw, err := initiateDiscover(client, is, rand.Reader, config, func(key *PublicKey) error {
+			if !key.Equal(rs.PublicKey()) {
+				t.Error("discovered the wrong responder key")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error("initiate error:", err)
+			return
+		}
+		clientConn = rw
+	}()
+	wg.Wait()
+
+	if clientConn == nil || serverConn == nil {
+		t.FailNow()
+	}
+
+	if !serverConn.RemoteKey().Equal(is.PublicKey()) {
+		t.Error("responder has the wrong initiator key")
+	}
+
+	serverSend := serverConn.send.Derive("a", nil, 8)
+	clientRecv := clientConn.recv.Derive("a", nil, 8)
+	if !bytes.Equal(serverSend, clientRecv) {
+		t.Errorf("expected serverSend == clientRecv, but was %v/%v", serverSend, clientRecv)
+	}
+}
+
+func TestInitiateAny(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := func(keys ...*PrivateKey) func(key *PublicKey) bool {
+		return func(key *PublicKey) bool {
+			return slices.ContainsFunc(keys, func(k *PrivateKey) bool { return k.PublicKey().Equal(key) })
+		}
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		client, server, clientErr, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return InitiateAny(rw, is, trusted(other, rs), rand.Reader, nil)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, &Config{AllowDiscovery: true}, AllowAllPolicy)
+			},
+		)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+		}
+
+		if !client.RemoteKey().Equal(rs.PublicKey()) {
+			t.Error("initiator has the wrong responder key")
+		}
+
+		if !server.RemoteKey().Equal(is.PublicKey()) {
+			t.Error("responder has the wrong initiator key")
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		_, _, clientErr, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return InitiateAny(rw, is, trusted(other), rand.Reader, nil)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, &Config{AllowDiscovery: true}, AllowAllPolicy)
+			},
+		)
+
+		if !errors.Is(clientErr, ErrResponderNotAllowed) {
+			t.Errorf("expected %v but was %v", ErrResponderNotAllowed, clientErr)
+		}
+
+		if serverErr == nil {
+			t.Error("expected responder to fail")
+		}
+	})
+
+	t.Run("discovery not allowed", func(t *testing.T) {
+		_, _, clientErr, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return InitiateAny(rw, is, trusted(rs), rand.Reader, nil)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, nil, AllowAllPolicy)
+			},
+		)
+
+		if !errors.Is(serverErr, ErrInitiatorNotAllowed) {
+			t.Errorf("expected %v but was %v", ErrInitiatorNotAllowed, serverErr)
+		}
+
+		if clientErr == nil {
+			t.Error("expected initiator to fail")
+		}
+	})
+}
+
+func TestAnonymousInitiator(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := func(key *PublicKey, earlyData []byte) bool {
+		t.Error("policy should not be called for anonymous initiators")
+		return false
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		// With RatchetAfterBytes unset, every write ratchets, which exercises ratcheting without the initiator's static key.
+		config := &Config{AllowAnonymous: true}
+		client, server, clientErr, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return InitiateAnonymous(rw, rs.PublicKey(), rand.Reader, config)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, config, policy)
+			},
+		)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+		}
+
+		if !client.ConnectionState().Anonymous || !server.ConnectionState().Anonymous {
+			t.Error("expected both peers to report an anonymous connection")
+		}
+
+		if client.LocalKey() != nil || server.RemoteKey() != nil {
+			t.Error("expected the initiator to have no static key")
+		}
+
+		// The initiator ratchets from its initial ratchet key, not its handshake ephemeral key, and doesn't keep it.
+		if client.localKey != nil {
+			t.Error("expected the initiator not to keep a stand-in static key")
+		}
+
+		if !client.RemoteKey().Equal(rs.PublicKey()) {
+			t.Error("initiator has the wrong responder key")
+		}
+
+		for _, pair := range [][2]*Conn{{client, server}, {server, client}} {
+			go func() {
+				if _, err := pair[0].Write([]byte("hello")); err != nil {
+					t.Errorf("write error: %v", err)
+				}
+			}()
+
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(pair[1], buf); err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if string(buf) != "hello" {
+				t.Errorf("expected hello but was %q", buf)
+			}
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, _, _, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return InitiateAnonymous(rw, rs.PublicKey(), rand.Reader, nil)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, nil, policy)
+			},
+		)
+
+		if !errors.Is(serverErr, ErrInitiatorNotAllowed) {
+			t.Errorf("expected %v but was %v", ErrInitiatorNotAllowed, serverErr)
+		}
+	})
+}
+
+func TestRespondKeys(t *testing.T) {
+	oldKey, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retiredKey, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rs := range []*PrivateKey{newKey, oldKey, retiredKey} {
+		client, server := net.Pipe()
+		if err := client.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		var serverConn *Conn
+		var serverErr error
+		wg := new(sync.WaitGroup)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				_ = server.Close()
+			}()
+
+			serverConn, serverErr = RespondKeys(server, []*PrivateKey{newKey, oldKey}, rand.Reader, nil, AllowAllPolicy)
+		}()
+		go func() {
+			defer wg.Done()
+			defer func() {
+				_ = client.Close()
+			}()
+
+			_, _ = Initiate(client, is, rs.PublicKey(), rand.Reader, nil)
+		}()
+		wg.Wait()
+
+		if rs == retiredKey {
+			if serverErr == nil {
+				t.Error("should not have accepted a handshake with a retired key")
+			}
+			continue
+		}
+
+		if serverErr != nil {
+			t.Fatal(serverErr)
+		}
+
+		if !serverConn.LocalKey().Equal(rs.PublicKey()) {
+			t.Errorf("expected responder to use %s but was %s", Fingerprint(rs.PublicKey()), Fingerprint(serverConn.LocalKey()))
+		}
+	}
+}
+
+func TestHybridMismatch(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hybrid := range []bool{false, true} {
+		for _, test := range []struct {
+			name     string
+			initiate func(rw io.ReadWriter, config *Config) (*Conn, error)
+		}{
+			{"standard", func(rw io.ReadWriter, config *Config) (*Conn, error) {
+				return Initiate(rw, is, rs.PublicKey(), rand.Reader, config)
+			}},
+			{"discover", func(rw io.ReadWriter, config *Config) (*Conn, error) {
+				return initiateDiscover(rw, is, rand.Reader, config, func(*PublicKey) error { return nil })
+			}},
+		} {
+			_, _, _, serverErr := testHandshake(t,
+				func(rw io.ReadWriter) (*Conn, error) {
+					return test.initiate(rw, &Config{Hybrid: hybrid})
+				},
+				func(rw io.ReadWriter) (*Conn, error) {
+					return Respond(rw, rs, rand.Reader, &Config{Hybrid: !hybrid, AllowDiscovery: true}, AllowAllPolicy)
+				},
+			)
+
+			if !errors.Is(serverErr, ErrHybridMismatch) {
+				t.Errorf("%s, hybrid=%v: expected %v but was %v", test.name, hybrid, ErrHybridMismatch, serverErr)
+			}
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("version 1 initiator", func(t *testing.T) {
+		_, _, _, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				// Send a request the way the original protocol did: the initiator's static public key, sealed
+				// directly after its ephemeral public key.
+				ie, err := GenerateKey(rand.Reader)
+				if err != nil {
+					return nil, err
+				}
+				req, err := elligator.Encode(ie.PublicKey().Bytes(), rand.Reader)
+				if err != nil {
+					return nil, err
+				}
+
+				yr := lockstitch.NewProtocol("yrgourd.v1")
+				yr.Mix("rs", rs.PublicKey().Bytes())
+				yr.Mix("ie", req)
+				ss, err := ie.ECDH(rs.PublicKey())
+				if err != nil {
+					return nil, err
+				}
+				yr.Mix("ie-rs", ss)
+				req = yr.Seal("is", req, is.PublicKey().Bytes())
+
+				if _, err := rw.Write(req); err != nil {
+					return nil, err
+				}
+				_, err = rw.Read(make([]byte, 1))
+				return nil, err
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, nil, AllowAllPolicy)
+			},
+		)
+
+		if !errors.Is(serverErr, ErrUnsupportedVersion) {
+			t.Errorf("expected %v but was %v", ErrUnsupportedVersion, serverErr)
+		}
+	})
+
+	// Requests which are shorter than a version 1 request are padded, so the responder can reject them without
+	// waiting for more.
+	other, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		initiate func(rw io.ReadWriter) (*Conn, error)
+	}{
+		{"anonymous", func(rw io.ReadWriter) (*Conn, error) {
+			return InitiateAnonymous(rw, other.PublicKey(), rand.Reader, nil)
+		}},
+		{"discover", func(rw io.ReadWriter) (*Conn, error) {
+			return initiateDiscover(rw, is, rand.Reader, &Config{PreSharedKey: make([]byte, PreSharedKeyLen)},
+				func(*PublicKey) error { return nil })
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, clientErr, serverErr := testHandshake(t, test.initiate,
+				func(rw io.ReadWriter) (*Conn, error) {
+					return Respond(rw, rs, rand.Reader, &Config{AllowAnonymous: true, AllowDiscovery: true}, AllowAllPolicy)
+				},
+			)
+
+			if !errors.Is(serverErr, ErrInvalidHandshake) {
+				t.Errorf("expected %v but was %v", ErrInvalidHandshake, serverErr)
+			}
+			if clientErr == nil || errors.Is(clientErr, os.ErrDeadlineExceeded) {
+				t.Errorf("expected the handshake to fail promptly but was %v", clientErr)
+			}
+		})
+	}
+}
+
+func TestPreSharedKey(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	psk := make([]byte, PreSharedKeyLen)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+
+	otherPSK := make([]byte, PreSharedKeyLen)
+	if _, err := rand.Read(otherPSK); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name                       string
+		initiatorPSK, responderPSK []byte
+		ok                         bool
+	}{
+		{"matching", psk, psk, true},
+		{"mismatched", psk, otherPSK, false},
+		{"initiator only", psk, nil, false},
+		{"responder only", nil, psk, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, serverErr := testHandshake(t,
+				func(rw io.ReadWriter) (*Conn, error) {
+					return Initiate(rw, is, rs.PublicKey(), rand.Reader, &Config{PreSharedKey: test.initiatorPSK})
+				},
+				func(rw io.ReadWriter) (*Conn, error) {
+					return Respond(rw, rs, rand.Reader, &Config{PreSharedKey: test.responderPSK}, AllowAllPolicy)
+				},
+			)
+
+			if test.ok && serverErr != nil {
+				t.Errorf("expected handshake to succeed but was %v", serverErr)
+			} else if !test.ok && !errors.Is(serverErr, ErrInvalidHandshake) {
+				t.Errorf("expected %v but was %v", ErrInvalidHandshake, serverErr)
+			}
+		})
+	}
+
+	if _, err := Initiate(nil, is, rs.PublicKey(), rand.Reader, &Config{PreSharedKey: psk[:16]}); !errors.Is(err, ErrInvalidPreSharedKey) {
+		t.Errorf("expected %v but was %v", ErrInvalidPreSharedKey, err)
+	}
+}
+
+// testHandshake runs the given initiator and responder functions concurrently over a pipe and returns their results.
+// If either side fails, the pipe is closed to unblock the other.
+func testHandshake(t *testing.T, initiate, respond func(rw io.ReadWriter) (*Conn, error)) (client, server *Conn, clientErr, serverErr error) {
+	t.Helper()
+
+	clientPipe, serverPipe := net.Pipe()
+	deadline := time.Now().Add(1 * time.Second)
+	if err := clientPipe.SetDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverPipe.SetDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = clientPipe.Close()
+		_ = serverPipe.Close()
+	})
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		client, clientErr = initiate(clientPipe)
+		if clientErr != nil {
+			_ = clientPipe.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+
+		server, serverErr = respond(serverPipe)
+		if serverErr != nil {
+			_ = serverPipe.Close()
+		}
+	}()
+	wg.Wait()
+
+	if client != nil && server != nil {
+		_ = clientPipe.SetDeadline(time.Time{})
+		_ = serverPipe.SetDeadline(time.Time{})
+	}
+
+	return client, server, clientErr, serverErr
+}
@@ -0,0 +1,92 @@
+package yrgourd
+
+import (
+	"crypto/mlkem"
+	"io"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+// A hybrid handshake adds an ML-KEM-768 encapsulation to the four P-256 Diffie-Hellman shared secrets. The responder
+// generates an ephemeral ML-KEM key pair and sends its encapsulation key once the Diffie-Hellman shared secrets have
+// been mixed in; the initiator encapsulates a shared secret to it and sends the ciphertext. Because the KEM shared
+// secret is mixed into the protocol before it forks, the connection remains confidential if P-256 is broken as long as
+// ML-KEM-768 is not.
+
+// newProtocol returns a protocol initialized for the configured handshake version.
+func newProtocol(config *Config) lockstitch.Protocol {
+	if config.Hybrid {
+		return lockstitch.NewProtocol("yrgourd.v2")
+	}
+	return lockstitch.NewProtocol("yrgourd.v1")
+}
+
+// sealKEMKey generates an ephemeral ML-KEM-768 key pair and appends its sealed encapsulation key to dst.
+func sealKEMKey(yr *lockstitch.Protocol, dst []byte, rand io.Reader) ([]byte, *mlkem.DecapsulationKey768, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return yr.Seal("ek", dst, dk.EncapsulationKey().Bytes()), dk, nil
+}
+
+// openKEMKey reads and opens the responder's sealed ML-KEM-768 encapsulation key.
+func openKEMKey(r io.Reader, yr *lockstitch.Protocol) (*mlkem.EncapsulationKey768, error) {
+	b := make([]byte, kemKeyLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	b, err := yr.Open("ek", b[:0], b)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(b)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	return ek, nil
+}
+
+// sealKEMCiphertext encapsulates a shared secret to the responder's encapsulation key, appends the sealed ciphertext to
+// dst, and mixes in the shared secret.
+func sealKEMCiphertext(yr *lockstitch.Protocol, dst []byte, ek *mlkem.EncapsulationKey768) []byte {
+	ss, ct := ek.Encapsulate()
+	dst = yr.Seal("ct", dst, ct)
+	yr.Mix("kem-ss", ss)
+	return dst
+}
+
+// openKEMCiphertext reads and opens the initiator's sealed ciphertext, decapsulates the shared secret, and mixes it in.
+func openKEMCiphertext(r io.Reader, yr *lockstitch.Protocol, dk *mlkem.DecapsulationKey768) error {
+	b := make([]byte, kemCiphertextLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	b, err := yr.Open("ct", b[:0], b)
+	if err != nil {
+		return ErrInvalidHandshake
+	}
+
+	ss, err := dk.Decapsulate(b)
+	if err != nil {
+		return ErrInvalidHandshake
+	}
+	yr.Mix("kem-ss", ss)
+	return nil
+}
+
+const (
+	// ek + tag
+	kemKeyLen = mlkem.EncapsulationKeySize768 + lockstitch.TagLen
+	// ct + tag
+	kemCiphertextLen = mlkem.CiphertextSize768 + lockstitch.TagLen
+)
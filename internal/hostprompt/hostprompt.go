@@ -0,0 +1,37 @@
+// Package hostprompt asks the user whether to trust the key of a host which isn't in a known hosts file.
+package hostprompt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+// Ask shows the host's key fingerprint and randomart on the terminal and returns true if the user answers "yes". It
+// can be used as KnownHosts.Ask.
+func Ask(address string, key *yrgourd.PublicKey) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		log.Println("unable to ask about unknown host", address, err)
+		return false
+	}
+	defer func() {
+		_ = tty.Close()
+	}()
+
+	return ask(tty, address, key)
+}
+
+// ask asks about the host on the given terminal.
+func ask(tty io.ReadWriter, address string, key *yrgourd.PublicKey) bool {
+	_, _ = fmt.Fprintf(tty, "The authenticity of host %s can't be established.\nKey fingerprint is %s.\n%s\n",
+		address, yrgourd.Fingerprint(key), yrgourd.Randomart(key))
+	_, _ = fmt.Fprint(tty, "Are you sure you want to continue connecting (yes/no)? ")
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
@@ -0,0 +1,34 @@
+package hostprompt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+func TestAsk(t *testing.T) {
+	k, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for answer, expected := range map[string]bool{"yes\n": true, "no\n": false, "": false} {
+		var out bytes.Buffer
+		tty := struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(answer), &out}
+
+		if actual := ask(tty, "example.com:4040", k.PublicKey()); actual != expected {
+			t.Errorf("%q: expected %v but was %v", answer, expected, actual)
+		}
+
+		if !strings.Contains(out.String(), yrgourd.Fingerprint(k.PublicKey())) {
+			t.Errorf("expected the prompt to show the fingerprint but was %q", out.String())
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package keyfile reads and writes the key files used by the yrgourd commands.
+//
+// Keys can be encoded as hex, base64, or PEM. Private keys are stored as raw P-256 scalars in hex and base64 and as
+// PKCS #8 in PEM; public keys are stored as compressed SEC 1 points in hex and base64 and as PKIX in PEM. Parsing
+// detects the encoding automatically and accepts both compressed and uncompressed points.
+package keyfile
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+const (
+	Hex    = "hex"
+	Base64 = "base64"
+	PEM    = "pem"
+)
+
+var ErrUnknownFormat = errors.New("keyfile: unknown key format")
+
+// EncodePrivateKey encodes the private key in the given format.
+func EncodePrivateKey(k *yrgourd.PrivateKey, format string) ([]byte, error) {
+	switch format {
+	case Hex:
+		return []byte(hex.EncodeToString(k.Bytes()) + "\n"), nil
+	case Base64:
+		return []byte(base64.StdEncoding.EncodeToString(k.Bytes()) + "\n"), nil
+	case PEM:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// EncodePublicKey encodes the public key in the given format.
+func EncodePublicKey(k *yrgourd.PublicKey, format string) ([]byte, error) {
+	switch format {
+	case Hex:
+		return []byte(hex.EncodeToString(yrgourd.CompressPublicKey(k)) + "\n"), nil
+	case Base64:
+		return []byte(base64.StdEncoding.EncodeToString(yrgourd.CompressPublicKey(k)) + "\n"), nil
+	case PEM:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// ParsePrivateKey parses a private key in any of the supported formats.
+func ParsePrivateKey(data []byte) (*yrgourd.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("keyfile: unexpected PEM block %q", block.Type)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case *ecdh.PrivateKey:
+			return yrgourd.NewPrivateKey(k.Bytes())
+		case *ecdsa.PrivateKey:
+			ek, err := k.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			return yrgourd.NewPrivateKey(ek.Bytes())
+		default:
+			return nil, fmt.Errorf("keyfile: unsupported private key type %T", k)
+		}
+	}
+
+	b, err := decodeText(data)
+	if err != nil {
+		return nil, err
+	}
+	return yrgourd.NewPrivateKey(b)
+}
+
+// ParsePublicKey parses a public key in any of the supported formats.
+func ParsePublicKey(data []byte) (*yrgourd.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("keyfile: unexpected PEM block %q", block.Type)
+		}
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case *ecdh.PublicKey:
+			return yrgourd.NewPublicKey(k.Bytes())
+		case *ecdsa.PublicKey:
+			ek, err := k.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			return yrgourd.NewPublicKey(ek.Bytes())
+		default:
+			return nil, fmt.Errorf("keyfile: unsupported public key type %T", k)
+		}
+	}
+
+	b, err := decodeText(data)
+	if err != nil {
+		return nil, err
+	}
+	return yrgourd.NewPublicKey(b)
+}
+
+// ReadPrivateKey reads and parses the private key file at the given path.
+func ReadPrivateKey(path string) (*yrgourd.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// ReadPublicKey reads and parses the public key file at the given path.
+func ReadPublicKey(path string) (*yrgourd.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// WriteKeyPair writes the private key to the given path with 0600 permissions and its public key to the same path
+// with a .pub suffix. It refuses to overwrite existing files.
+func WriteKeyPair(path string, k *yrgourd.PrivateKey, format string) error {
+	priv, err := EncodePrivateKey(k, format)
+	if err != nil {
+		return err
+	}
+
+	pub, err := EncodePublicKey(k.PublicKey(), format)
+	if err != nil {
+		return err
+	}
+
+	if err := writeNewFile(path, priv, 0600); err != nil {
+		return err
+	}
+	return writeNewFile(path+".pub", pub, 0644)
+}
+
+func decodeText(data []byte) ([]byte, error) {
+	s := string(bytes.TrimSpace(data))
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,71 @@
+package keyfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+func TestRoundTrip(t *testing.T) {
+	k, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{Hex, Base64, PEM} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key")
+			if err := WriteKeyPair(path, k, format); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Errorf("expected private key permissions of 0600 but was %v", perm)
+			}
+
+			priv, err := ReadPrivateKey(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !priv.Equal(k) {
+				t.Error("private key mismatch")
+			}
+
+			pub, err := ReadPublicKey(path + ".pub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pub.Equal(k.PublicKey()) {
+				t.Error("public key mismatch")
+			}
+
+			if err := WriteKeyPair(path, k, format); err == nil {
+				t.Error("should not have overwritten existing key file")
+			}
+		})
+	}
+}
+
+func TestParseUncompressedPublicKey(t *testing.T) {
+	k, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ParsePublicKey([]byte(hex.EncodeToString(k.PublicKey().Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pub.Equal(k.PublicKey()) {
+		t.Error("public key mismatch")
+	}
+}
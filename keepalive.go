@@ -0,0 +1,160 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keepalive sends ping frames over an idle connection and detects peers which have stopped responding.
+//
+// If nothing has been received from the remote peer for the keepalive interval, the local peer sends a ping frame
+// containing the time it was sent, and the remote peer answers with a pong frame containing the same value, which the
+// local peer matches against its most recent ping to measure the round-trip time.
+//
+// Frames are only received while the connection is being read, so the idle timeout only runs while a read is waiting
+// for the remote peer, counting from the later of the start of the read and the last frame received. If it expires,
+// the connection is considered dead, and Read and Write return ErrIdleTimeout. A connection which is only written to is
+// never considered dead.
+type keepalive struct {
+	interval, idleTimeout time.Duration
+	epoch                 time.Time
+	lastRecv              atomic.Int64
+	reading               atomic.Bool
+	pinged                atomic.Uint64 // the body of the most recent unanswered ping, if any
+	rtt                   atomic.Int64
+	dead                  atomic.Bool
+	quit, exited          chan struct{}
+	stopOnce              sync.Once
+}
+
+// newKeepalive returns a keepalive for the given configuration, or nil if neither keepalives nor idle timeouts are
+// enabled. Pings are only sent if the remote peer supports them.
+func newKeepalive(config *Config, state ConnectionState) *keepalive {
+	interval := config.KeepaliveInterval
+	if state.Features&FeatureKeepalive == 0 {
+		interval = 0
+	}
+
+	if interval <= 0 && config.IdleTimeout <= 0 {
+		return nil
+	}
+
+	k := &keepalive{
+		interval:    interval,
+		idleTimeout: config.IdleTimeout,
+		epoch:       time.Now(),
+		quit:        make(chan struct{}),
+		exited:      make(chan struct{}),
+	}
+	k.received()
+	return k
+}
+
+// sendKeepalives sends pings and checks for an idle peer until the keepalive is stopped or the peer is declared dead.
+func (c *Conn) sendKeepalives() {
+	k := c.keepalive
+	defer close(k.exited)
+
+	ticker := time.NewTicker(k.tick())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.quit:
+			return
+		case <-ticker.C:
+		}
+
+		idle := k.idle()
+		if k.idleTimeout > 0 && k.reading.Load() && idle >= k.idleTimeout {
+			// Declare the peer dead and unblock any pending reads or writes.
+			k.dead.Store(true)
+			if d, ok := c.rw.(interface{ SetDeadline(time.Time) error }); ok {
+				_ = d.SetDeadline(time.Unix(1, 0))
+			} else if closer, ok := c.rw.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			return
+		}
+
+		if k.interval > 0 && idle >= k.interval {
+			sent := k.elapsed()
+			k.pinged.Store(sent)
+			if err := c.sendFrame(framePing, binary.BigEndian.AppendUint64(nil, sent), nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tick returns how often the keepalive checks the connection.
+func (k *keepalive) tick() time.Duration {
+	tick := k.interval
+	if k.idleTimeout > 0 && (tick <= 0 || k.idleTimeout/4 < tick) {
+		tick = k.idleTimeout / 4
+	}
+	return max(tick, time.Millisecond)
+}
+
+// received records that a frame was received from the remote peer.
+func (k *keepalive) received() {
+	k.lastRecv.Store(int64(time.Since(k.epoch)))
+}
+
+// startReading records that a read is waiting for the remote peer, which starts the idle timeout.
+func (k *keepalive) startReading() {
+	k.received()
+	k.reading.Store(true)
+}
+
+// stopReading records that no read is waiting for the remote peer, which stops the idle timeout.
+func (k *keepalive) stopReading() {
+	k.reading.Store(false)
+}
+
+// idle returns the time since a frame was last received from the remote peer.
+func (k *keepalive) idle() time.Duration {
+	return time.Since(k.epoch) - time.Duration(k.lastRecv.Load())
+}
+
+// elapsed returns the time since the keepalive's epoch, in nanoseconds, which is used as the body of a ping.
+func (k *keepalive) elapsed() uint64 {
+	return uint64(time.Since(k.epoch))
+}
+
+// pong records the round-trip time from the body of a pong frame if it answers the most recent ping. Pongs which don't,
+// such as late answers to earlier pings, are ignored.
+func (k *keepalive) pong(body []byte) error {
+	if len(body) != pingLen {
+		return ErrInvalidFrame
+	}
+
+	sent := binary.BigEndian.Uint64(body)
+	if sent == 0 || !k.pinged.CompareAndSwap(sent, 0) {
+		return nil
+	}
+	k.rtt.Store(int64(k.elapsed() - sent))
+	return nil
+}
+
+// stop stops the keepalive and waits for it to exit.
+func (k *keepalive) stop() {
+	k.stopOnce.Do(func() {
+		close(k.quit)
+	})
+	<-k.exited
+}
+
+// timeout returns ErrIdleTimeout in place of err if the remote peer was declared dead.
+func (c *Conn) timeout(err error) error {
+	if c.keepalive != nil && c.keepalive.dead.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+// nanoseconds since the keepalive's epoch
+const pingLen = 8
@@ -0,0 +1,122 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	connect := func(t *testing.T, clientConfig, serverConfig *Config) (client, server *Conn) {
+		t.Helper()
+
+		client, server = testConnPair(t, clientConfig, serverConfig)
+		t.Cleanup(func() {
+			// Close the underlying connections first so that close_notify frames don't block.
+			_ = client.rw.(io.Closer).Close()
+			_ = server.rw.(io.Closer).Close()
+			_ = client.Close()
+			_ = server.Close()
+		})
+		return client, server
+	}
+
+	t.Run("rtt", func(t *testing.T) {
+		client, server := connect(t, &Config{KeepaliveInterval: 5 * time.Millisecond}, nil)
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+
+		for deadline := time.Now().Add(time.Second); client.Stats().RTT == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("no round-trip time measured")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if server.Stats().RTT != 0 {
+			t.Error("expected no round-trip time for the peer which sent no pings")
+		}
+	})
+
+	t.Run("alive", func(t *testing.T) {
+		config := &Config{KeepaliveInterval: 5 * time.Millisecond, IdleTimeout: 50 * time.Millisecond}
+		client, server := connect(t, config, config)
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+
+		errs := make(chan error, 1)
+		go func() {
+			b := make([]byte, 5)
+			_, err := io.ReadFull(server, b)
+			errs <- err
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("dead", func(t *testing.T) {
+		client, _ := connect(t, &Config{IdleTimeout: 20 * time.Millisecond}, nil)
+
+		if _, err := client.Read(make([]byte, 1)); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected %v but was %v", ErrIdleTimeout, err)
+		}
+
+		if _, err := client.Write([]byte("hello")); !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("expected %v but was %v", ErrIdleTimeout, err)
+		}
+	})
+	t.Run("write only", func(t *testing.T) {
+		client, server := connect(t, &Config{IdleTimeout: 20 * time.Millisecond}, nil)
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+
+		// The server never writes, but the client isn't waiting for it, so it isn't considered dead.
+		for range 5 {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestKeepalivePong(t *testing.T) {
+	k := &keepalive{epoch: time.Now().Add(-time.Second)}
+
+	sent := k.elapsed()
+	k.pinged.Store(sent)
+
+	// Pongs which don't answer the most recent ping are ignored.
+	if err := k.pong(binary.BigEndian.AppendUint64(nil, sent-1)); err != nil {
+		t.Fatal(err)
+	}
+	if k.rtt.Load() != 0 {
+		t.Error("expected a stale pong to be ignored")
+	}
+
+	if err := k.pong(binary.BigEndian.AppendUint64(nil, sent)); err != nil {
+		t.Fatal(err)
+	}
+	if k.rtt.Load() <= 0 {
+		t.Error("expected a round-trip time")
+	}
+
+	// Each ping is only answered once.
+	k.rtt.Store(0)
+	if err := k.pong(binary.BigEndian.AppendUint64(nil, sent)); err != nil {
+		t.Fatal(err)
+	}
+	if k.rtt.Load() != 0 {
+		t.Error("expected a duplicate pong to be ignored")
+	}
+
+	if err := k.pong(make([]byte, pingLen-1)); !errors.Is(err, ErrInvalidFrame) {
+		t.Errorf("expected %v but was %v", ErrInvalidFrame, err)
+	}
+}
@@ -0,0 +1,202 @@
+package yrgourd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HostKeyMode determines how a KnownHosts store treats hosts without a pinned static public key.
+type HostKeyMode int
+
+const (
+	// StrictHostKeys rejects hosts without a pinned key.
+	StrictHostKeys HostKeyMode = iota
+	// TOFUHostKeys pins the key a host presents the first time it is seen (trust on first use).
+	TOFUHostKeys
+	// AskHostKeys calls KnownHosts.Ask to decide whether to pin the key a host presents the first time it is seen.
+	AskHostKeys
+)
+
+// String returns the mode's name: "strict", "tofu", or "ask".
+func (m HostKeyMode) String() string {
+	switch m {
+	case StrictHostKeys:
+		return "strict"
+	case TOFUHostKeys:
+		return "tofu"
+	case AskHostKeys:
+		return "ask"
+	default:
+		return fmt.Sprintf("HostKeyMode(%d)", int(m))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m HostKeyMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *HostKeyMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "strict":
+		*m = StrictHostKeys
+	case "tofu":
+		*m = TOFUHostKeys
+	case "ask":
+		*m = AskHostKeys
+	default:
+		return fmt.Errorf("yrgourd: unknown host key mode %q", text)
+	}
+	return nil
+}
+
+var (
+	ErrUnknownHost     = errors.New("yrgourd: unknown host")
+	ErrHostKeyMismatch = errors.New("yrgourd: host key mismatch")
+)
+
+// KnownHosts maps host addresses to pinned responder static public keys, like OpenSSH's known_hosts file.
+//
+// The file format is one host per line: the address, whitespace, and the host's public key in hex. Blank lines and
+// lines starting with '#' are ignored.
+type KnownHosts struct {
+	// Mode determines how hosts without a pinned key are handled.
+	Mode HostKeyMode
+
+	// Ask is called in AskHostKeys mode with the address and key of a host without a pinned key. If it returns true,
+	// the key is pinned and the connection proceeds.
+	Ask func(address string, key *PublicKey) bool
+
+	path  string
+	mu    sync.Mutex
+	hosts map[string]*PublicKey
+}
+
+// NewKnownHosts returns an empty, in-memory KnownHosts store with the given mode.
+func NewKnownHosts(mode HostKeyMode) *KnownHosts {
+	return &KnownHosts{Mode: mode, hosts: make(map[string]*PublicKey)}
+}
+
+// LoadKnownHosts reads a known hosts file. Keys pinned later are appended to the file. If the file does not exist, it
+// will be created when the first key is pinned.
+func LoadKnownHosts(path string, mode HostKeyMode) (*KnownHosts, error) {
+	kh := NewKnownHosts(mode)
+	kh.path = path
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kh, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, line)
+		}
+
+		b, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		key, err := NewPublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		kh.hosts[fields[0]] = key
+	}
+	return kh, s.Err()
+}
+
+// Lookup returns the key pinned for the given address, if any.
+func (kh *KnownHosts) Lookup(address string) *PublicKey {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	return kh.hosts[address]
+}
+
+// Add pins the key for the given address, appending it to the known hosts file, if any.
+func (kh *KnownHosts) Add(address string, key *PublicKey) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	return kh.add(address, key)
+}
+
+// Verify checks the key presented by the host at the given address. If the host has a pinned key, the presented key
+// must match it. Otherwise, the presented key is handled according to the store's mode.
+func (kh *KnownHosts) Verify(address string, key *PublicKey) error {
+	if pinned := kh.Lookup(address); pinned != nil {
+		return matchHostKey(address, key, pinned)
+	}
+
+	switch kh.Mode {
+	case TOFUHostKeys:
+		return kh.pin(address, key)
+	case AskHostKeys:
+		// Ask may block on a user, so it's called without holding the lock.
+		if kh.Ask != nil && kh.Ask(address, key) {
+			return kh.pin(address, key)
+		}
+	}
+	return fmt.Errorf("%w: %s presented %s", ErrUnknownHost, address, Fingerprint(key))
+}
+
+// pin pins the key for the given address unless another key was pinned for it in the meantime, in which case the key
+// must match it.
+func (kh *KnownHosts) pin(address string, key *PublicKey) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	if pinned, ok := kh.hosts[address]; ok {
+		return matchHostKey(address, key, pinned)
+	}
+	return kh.add(address, key)
+}
+
+// matchHostKey returns ErrHostKeyMismatch if the key presented by the host at the given address isn't its pinned key.
+func matchHostKey(address string, key, pinned *PublicKey) error {
+	if !pinned.Equal(key) {
+		return fmt.Errorf("%w: %s presented %s but %s is pinned", ErrHostKeyMismatch, address, Fingerprint(key),
+			Fingerprint(pinned))
+	}
+	return nil
+}
+
+func (kh *KnownHosts) add(address string, key *PublicKey) error {
+	if kh.path != "" {
+		f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(f, "%s %s\n", address, hex.EncodeToString(CompressPublicKey(key))); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	kh.hosts[address] = key
+	return nil
+}
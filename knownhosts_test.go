@@ -0,0 +1,168 @@
+package yrgourd
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHostsTOFU(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listenAndRespond(t, rs, &Config{AllowDiscovery: true})
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	kh, err := LoadKnownHosts(path, TOFUHostKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Dialer{Key: is, KnownHosts: kh}
+	for range 2 {
+		conn, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !conn.RemoteKey().Equal(rs.PublicKey()) {
+			t.Error("remote key mismatch")
+		}
+		_ = conn.Close()
+	}
+
+	kh, err = LoadKnownHosts(path, StrictHostKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned := kh.Lookup(addr); pinned == nil || !pinned.Equal(rs.PublicKey()) {
+		t.Errorf("expected %s to be pinned to %s but was %v", addr, Fingerprint(rs.PublicKey()), pinned)
+	}
+
+	impostor, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kh.Verify(addr, impostor.PublicKey()); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("expected %v but was %v", ErrHostKeyMismatch, err)
+	}
+
+	// Dialing a host which has a different key than the pinned one fails the handshake.
+	kh = NewKnownHosts(StrictHostKeys)
+	if err := kh.Add(addr, impostor.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	d = &Dialer{Key: is, KnownHosts: kh}
+	if _, err := d.Dial("tcp", addr); err == nil {
+		t.Error("expected the handshake to fail")
+	}
+}
+
+func TestKnownHostsStrict(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts with pinned keys don't need to allow discovery.
+	addr := listenAndRespond(t, rs, &Config{})
+
+	kh := NewKnownHosts(StrictHostKeys)
+	d := &Dialer{Key: is, KnownHosts: kh}
+	if _, err := d.Dial("tcp", addr); !errors.Is(err, ErrUnknownHost) {
+		t.Errorf("expected %v but was %v", ErrUnknownHost, err)
+	}
+
+	if err := kh.Add(addr, rs.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestKnownHostsAsk(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listenAndRespond(t, rs, &Config{AllowDiscovery: true})
+
+	kh := NewKnownHosts(AskHostKeys)
+	kh.Ask = func(address string, key *PublicKey) bool {
+		return false
+	}
+
+	d := &Dialer{Key: is, KnownHosts: kh}
+	if _, err := d.Dial("tcp", addr); !errors.Is(err, ErrUnknownHost) {
+		t.Errorf("expected %v but was %v", ErrUnknownHost, err)
+	}
+
+	// Ask may use the known hosts while it's being called.
+	kh.Ask = func(address string, key *PublicKey) bool {
+		return kh.Lookup(address) == nil && key.Equal(rs.PublicKey())
+	}
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func listenAndRespond(t *testing.T, rs *PrivateKey, config *Config) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = Respond(conn, rs, rand.Reader, config, AllowAllPolicy)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
@@ -0,0 +1,485 @@
+// Package mux multiplexes independent, flow-controlled streams over a single yrgourd connection.
+//
+// Each mux frame is sent as a single yrgourd message (see yrgourd.Conn.WriteMessage), so mux relies on the
+// connection's framing, encryption, and authentication and adds only a small header:
+//
+//	type (1 byte) || flags (1 byte) || stream ID (4 bytes) || value (4 bytes) || data
+//
+// Data frames carry stream data. Window update frames grant the remote peer permission to send more data on a stream,
+// the number of bytes being the value. Both carry flags which open (SYN), acknowledge (ACK), half-close (FIN), or reset
+// (RST) a stream. A go away frame tells the remote peer that no more streams will be accepted.
+//
+// Streams opened by the client have odd IDs, and streams opened by the server have even IDs. Each stream starts with a
+// 256KiB window in each direction, which the receiver grows to its maximum window when the stream is opened.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+// Config configures a session.
+type Config struct {
+	// AcceptBacklog is the number of streams opened by the remote peer which can wait to be accepted. Streams opened
+	// beyond that are reset. If zero, the backlog is 256 streams.
+	AcceptBacklog int
+
+	// MaxStreamWindow is the largest number of bytes the remote peer may send on a stream before it is read. If zero or
+	// less than 256KiB, it is 256KiB.
+	MaxStreamWindow int
+}
+
+var (
+	ErrSessionShutdown = errors.New("mux: session shutdown")
+	ErrRemoteGoAway    = errors.New("mux: remote peer is not accepting streams")
+	ErrStreamReset     = errors.New("mux: stream reset")
+	ErrStreamClosed    = errors.New("mux: stream closed")
+	ErrInvalidFrame    = errors.New("mux: invalid frame")
+	ErrControlOverflow = errors.New("mux: too many control frames waiting to be sent")
+)
+
+// A Session multiplexes streams over a yrgourd connection. It implements net.Listener, accepting streams opened by the
+// remote peer.
+type Session struct {
+	conn      *yrgourd.Conn
+	client    bool
+	backlog   int
+	maxWindow uint32
+
+	mu                        sync.Mutex
+	streams                   map[uint32]*Stream
+	nextID                    uint64
+	localGoAway, remoteGoAway bool
+
+	accept chan *Stream
+
+	controlMu    sync.Mutex
+	control      [][]byte
+	controlReady chan struct{}
+	data         chan *sendRequest
+	closing      chan struct{}
+	sendExited   chan struct{}
+
+	shutdown     chan struct{}
+	shutdownErr  error
+	shutdownOnce sync.Once
+	closeOnce    sync.Once
+}
+
+// Client returns a session for the initiator of a connection.
+func Client(conn *yrgourd.Conn, config *Config) *Session {
+	return newSession(conn, config, true)
+}
+
+// Server returns a session for the responder of a connection.
+func Server(conn *yrgourd.Conn, config *Config) *Session {
+	return newSession(conn, config, false)
+}
+
+func newSession(conn *yrgourd.Conn, config *Config, client bool) *Session {
+	if config == nil {
+		config = &Config{}
+	}
+
+	backlog := config.AcceptBacklog
+	if backlog <= 0 {
+		backlog = defaultAcceptBacklog
+	}
+
+	s := &Session{
+		conn:         conn,
+		client:       client,
+		backlog:      backlog,
+		maxWindow:    uint32(min(max(config.MaxStreamWindow, initialWindow), maxWindow)),
+		streams:      make(map[uint32]*Stream),
+		nextID:       2,
+		accept:       make(chan *Stream, backlog),
+		controlReady: make(chan struct{}, 1),
+		data:         make(chan *sendRequest),
+		closing:      make(chan struct{}),
+		sendExited:   make(chan struct{}),
+		shutdown:     make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+
+	go s.recvLoop()
+	go s.sendLoop()
+	return s
+}
+
+// Open opens a new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.shutdown:
+		return nil, s.err()
+	default:
+	}
+
+	if s.remoteGoAway {
+		return nil, ErrRemoteGoAway
+	}
+
+	if s.nextID > maxStreamID {
+		return nil, ErrSessionShutdown
+	}
+
+	st := newStream(s, uint32(s.nextID))
+	s.streams[st.id] = st
+	s.nextID += 2
+
+	// Open the stream and grow the remote peer's window.
+	if err := s.sendControl(typeWindowUpdate, flagSYN, st.id, s.maxWindow-initialWindow); err != nil {
+		delete(s.streams, st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the remote peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	// Prefer streams which were opened before the session shut down.
+	select {
+	case st := <-s.accept:
+		return st, nil
+	default:
+	}
+
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.shutdown:
+		return nil, s.err()
+	}
+}
+
+// Accept waits for and returns the next stream opened by the remote peer.
+func (s *Session) Accept() (net.Conn, error) {
+	st, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Addr returns the local peer's address.
+func (s *Session) Addr() net.Addr {
+	return Addr{Key: s.conn.LocalKey()}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+// GoAway tells the remote peer that no more streams will be accepted. Existing streams are unaffected.
+func (s *Session) GoAway() error {
+	s.mu.Lock()
+	s.localGoAway = true
+	s.mu.Unlock()
+
+	_ = s.sendControl(typeGoAway, 0, 0, 0)
+	return nil
+}
+
+// Close sends a go away frame, closes the underlying connection, and resets all streams.
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		_ = s.GoAway()
+
+		// Flush any pending control frames before closing the connection.
+		close(s.closing)
+		<-s.sendExited
+		err = s.conn.Close()
+		s.close(ErrSessionShutdown)
+	})
+	return err
+}
+
+// close shuts down the session with the given error, waking any streams waiting on it.
+func (s *Session) close(err error) {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = err
+		close(s.shutdown)
+	})
+}
+
+// err returns the error the session was shut down with.
+func (s *Session) err() error {
+	<-s.shutdown
+	return s.shutdownErr
+}
+
+// recvLoop reads and handles frames until the connection fails.
+func (s *Session) recvLoop() {
+	for {
+		msg, err := s.conn.ReadMessage()
+		if err != nil {
+			// The remote peer closing the connection cleanly is a shutdown, not the end of every stream.
+			if errors.Is(err, io.EOF) {
+				err = ErrSessionShutdown
+			}
+			s.close(err)
+			return
+		}
+
+		if err := s.handleFrame(msg); err != nil {
+			s.close(err)
+			_ = s.conn.Close()
+			return
+		}
+	}
+}
+
+// handleFrame handles a frame from the remote peer.
+func (s *Session) handleFrame(msg []byte) error {
+	if len(msg) < headerLen {
+		return ErrInvalidFrame
+	}
+
+	typ, flags := msg[0], msg[1]
+	id, value := binary.BigEndian.Uint32(msg[2:]), binary.BigEndian.Uint32(msg[6:])
+	data := msg[headerLen:]
+
+	switch typ {
+	case typeData, typeWindowUpdate:
+		return s.handleStreamFrame(typ, flags, id, value, data)
+	case typeGoAway:
+		s.mu.Lock()
+		s.remoteGoAway = true
+		s.mu.Unlock()
+		return nil
+	default:
+		return ErrInvalidFrame
+	}
+}
+
+// handleStreamFrame handles a data or window update frame.
+func (s *Session) handleStreamFrame(typ, flags byte, id, value uint32, data []byte) error {
+	if flags&flagSYN != 0 {
+		if err := s.incoming(id); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	// Reset streams we don't know about if the remote peer sends data on them. Window updates and resets may arrive
+	// after a stream has been removed, so they're ignored.
+	if st == nil {
+		if typ == typeData && flags&flagRST == 0 {
+			return s.sendControl(typeWindowUpdate, flagRST, id, 0)
+		}
+		return nil
+	}
+
+	if typ == typeWindowUpdate {
+		st.grow(value)
+	} else if len(data) > 0 && !st.receive(data) {
+		// The remote peer sent more than its window.
+		st.abort()
+		return nil
+	}
+
+	if flags&flagFIN != 0 {
+		st.remoteClose()
+	}
+	if flags&flagRST != 0 {
+		st.reset()
+	}
+	return nil
+}
+
+// incoming handles a stream opened by the remote peer.
+func (s *Session) incoming(id uint32) error {
+	// The remote peer may only open streams with its own IDs.
+	if (id%2 == 1) == s.client {
+		return ErrInvalidFrame
+	}
+
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return ErrInvalidFrame
+	}
+
+	// Refuse the stream if we've gone away or the backlog is full.
+	if s.localGoAway || len(s.accept) == s.backlog {
+		s.mu.Unlock()
+		return s.sendControl(typeWindowUpdate, flagRST, id, 0)
+	}
+
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.accept <- st
+	s.mu.Unlock()
+
+	// Acknowledge the stream and grow the remote peer's window.
+	return s.sendControl(typeWindowUpdate, flagACK, id, s.maxWindow-initialWindow)
+}
+
+// removeStream forgets a closed stream.
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+// sendRequest is a data frame waiting to be sent.
+type sendRequest struct {
+	msg  []byte
+	done chan error
+}
+
+// sendControl queues a control frame to be sent without waiting. Control frames are sent before any data frames which
+// are waiting, and never block the receive loop. If too many control frames are waiting, e.g. because the remote peer
+// sends frames which must be answered but doesn't read the answers, the session is shut down with ErrControlOverflow.
+func (s *Session) sendControl(typ, flags byte, id, value uint32) error {
+	s.controlMu.Lock()
+	if len(s.control) >= maxQueuedControl {
+		s.controlMu.Unlock()
+		s.close(ErrControlOverflow)
+		return ErrControlOverflow
+	}
+	s.control = append(s.control, appendHeader(nil, typ, flags, id, value))
+	s.controlMu.Unlock()
+
+	select {
+	case s.controlReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendData sends a data frame and waits for it to be written.
+func (s *Session) sendData(msg []byte) error {
+	req := &sendRequest{msg: msg, done: make(chan error, 1)}
+	select {
+	case s.data <- req:
+		return <-req.done
+	case <-s.shutdown:
+		return s.err()
+	case <-s.sendExited:
+		return ErrSessionShutdown
+	}
+}
+
+// sendLoop writes frames to the connection until the session is closed or a write fails.
+func (s *Session) sendLoop() {
+	defer close(s.sendExited)
+
+	for {
+		if err := s.flushControl(); err != nil {
+			s.close(err)
+			return
+		}
+
+		select {
+		case <-s.controlReady:
+		case req := <-s.data:
+			// Make sure any control frames opening the stream are sent before its data.
+			err := s.flushControl()
+			if err == nil {
+				err = s.conn.WriteMessage(req.msg)
+			}
+			req.done <- err
+			if err != nil {
+				s.close(err)
+				return
+			}
+		case <-s.closing:
+			_ = s.flushControl()
+			return
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// flushControl writes all the queued control frames.
+func (s *Session) flushControl() error {
+	s.controlMu.Lock()
+	control := s.control
+	s.control = nil
+	s.controlMu.Unlock()
+
+	for _, msg := range control {
+		if err := s.conn.WriteMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxData returns the largest amount of stream data which fits in a frame.
+func (s *Session) maxData() int {
+	return s.conn.MaxMessageSize() - headerLen
+}
+
+// Addr is the address of a peer in a session: its static public key.
+type Addr struct {
+	// Key is the peer's static public key, or nil if the peer is an anonymous initiator.
+	Key *yrgourd.PublicKey
+}
+
+// Network returns "yrgourd".
+func (a Addr) Network() string {
+	return "yrgourd"
+}
+
+// String returns the fingerprint of the peer's key, or "anonymous".
+func (a Addr) String() string {
+	if a.Key == nil {
+		return "anonymous"
+	}
+	return yrgourd.Fingerprint(a.Key)
+}
+
+// appendHeader appends a frame header to dst.
+func appendHeader(dst []byte, typ, flags byte, id, value uint32) []byte {
+	dst = append(dst, typ, flags)
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	return binary.BigEndian.AppendUint32(dst, value)
+}
+
+// Frame types.
+const (
+	typeData byte = iota
+	typeWindowUpdate
+	typeGoAway
+)
+
+// Frame flags.
+const (
+	flagSYN byte = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+const (
+	// type + flags + stream ID + value
+	headerLen = 1 + 1 + 4 + 4
+
+	initialWindow        = 256 * 1024
+	maxWindow            = 1<<31 - 1
+	maxStreamID          = 1<<32 - 1
+	defaultAcceptBacklog = 256
+	maxQueuedControl     = 4096
+)
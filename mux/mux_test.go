@@ -0,0 +1,387 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codahale/yrgourd-go"
+)
+
+func TestStreams(t *testing.T) {
+	client, server := testSessionPair(t, nil)
+
+	// Echo every stream the server accepts.
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(st, st)
+				_ = st.Close()
+			}()
+		}
+	}()
+
+	// Send more than a window's worth of data on each stream, so the streams have to wait for window updates.
+	message := make([]byte, 3*initialWindow+7)
+	if _, err := rand.Read(message); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			go func() {
+				if _, err := st.Write(message); err != nil {
+					t.Errorf("write error: %v", err)
+				}
+				_ = st.Close()
+			}()
+
+			actual, err := io.ReadAll(st)
+			if err != nil {
+				t.Errorf("read error: %v", err)
+				return
+			}
+
+			if !bytes.Equal(message, actual) {
+				t.Error("message mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := testSessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Write([]byte("again")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("expected %v but was %v", ErrStreamClosed, err)
+	}
+
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := st.ID(), remote.ID(); expected != actual {
+		t.Errorf("expected stream %d but was %d", expected, actual)
+	}
+
+	actual, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "hello"; expected != string(actual) {
+		t.Errorf("expected %q but was %q", expected, actual)
+	}
+
+	// The remote stream can still write until it closes.
+	if _, err := remote.Write([]byte("goodbye")); err != nil {
+		t.Fatal(err)
+	}
+	_ = remote.Close()
+
+	actual, err = io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "goodbye"; expected != string(actual) {
+		t.Errorf("expected %q but was %q", expected, actual)
+	}
+
+	waitFor(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := testSessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("expected %v but was %v", ErrStreamReset, err)
+	}
+
+	if _, err := st.Write([]byte("hello")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("expected %v but was %v", ErrStreamReset, err)
+	}
+
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("expected %v but was %v", ErrStreamReset, err)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, _ := testSessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v but was %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	client, server := testSessionPair(t, &Config{AcceptBacklog: 1})
+
+	first, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second stream doesn't fit in the backlog and is reset.
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("expected %v but was %v", ErrStreamReset, err)
+	}
+
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := first.ID(), remote.ID(); expected != actual {
+		t.Errorf("expected stream %d but was %d", expected, actual)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := testSessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.GoAway(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		_, err := client.Open()
+		return errors.Is(err, ErrRemoteGoAway)
+	})
+
+	// Existing streams are unaffected.
+	go func() {
+		_, _ = st.Write([]byte("hello"))
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "hello", string(buf); expected != actual {
+		t.Errorf("expected %q but was %q", expected, actual)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := testSessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Open(); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("expected %v but was %v", ErrSessionShutdown, err)
+	}
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("expected %v but was %v", ErrSessionShutdown, err)
+	}
+
+	// Drain the stream opened before the session closed.
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.AcceptStream(); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("expected %v but was %v", ErrSessionShutdown, err)
+	}
+
+	if _, err := server.Open(); err == nil {
+		t.Error("expected an error opening a stream on a closed session")
+	}
+}
+
+func TestInvalidStreamID(t *testing.T) {
+	client, _ := testSessionPair(t, nil)
+
+	// Streams opened by the server must have even IDs.
+	if err := client.handleFrame(appendHeader(nil, typeWindowUpdate, flagSYN, 1, 0)); !errors.Is(err, ErrInvalidFrame) {
+		t.Errorf("expected %v but was %v", ErrInvalidFrame, err)
+	}
+}
+
+func TestControlOverflow(t *testing.T) {
+	var client *Session
+	t.Cleanup(func() {
+		if client != nil {
+			_ = client.Close()
+		}
+	})
+	clientConn, _ := testConnPair(t)
+	client = Client(clientConn, nil)
+
+	// Window updates and resets for unknown streams aren't answered.
+	for id := uint32(2); id < 2*maxQueuedControl; id += 2 {
+		if err := client.handleFrame(appendHeader(nil, typeWindowUpdate, 0, id, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.handleFrame(appendHeader(nil, typeWindowUpdate, flagRST, id, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Data for unknown streams is answered with resets, which the server never reads.
+	var err error
+	for id := uint32(2); err == nil && id < 4*maxQueuedControl; id += 2 {
+		err = client.handleFrame(appendHeader(nil, typeData, 0, id, 0))
+	}
+	if !errors.Is(err, ErrControlOverflow) {
+		t.Errorf("expected %v but was %v", ErrControlOverflow, err)
+	}
+
+	if _, err := client.Open(); !errors.Is(err, ErrSessionShutdown) && !errors.Is(err, ErrControlOverflow) {
+		t.Errorf("expected the session to be shut down but was %v", err)
+	}
+}
+
+func testSessionPair(t *testing.T, config *Config) (client, server *Session) {
+	t.Helper()
+
+	// Close the sessions after the underlying connections, so that pending writes don't block.
+	t.Cleanup(func() {
+		if client != nil {
+			_ = client.Close()
+			_ = server.Close()
+		}
+	})
+	clientConn, serverConn := testConnPair(t)
+	client, server = Client(clientConn, config), Server(serverConn, config)
+	return client, server
+}
+
+func testConnPair(t *testing.T) (client, server *yrgourd.Conn) {
+	t.Helper()
+
+	rs, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := yrgourd.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPipe, serverPipe := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientPipe.Close()
+		_ = serverPipe.Close()
+	})
+
+	var (
+		clientConn, serverConn *yrgourd.Conn
+		clientErr, serverErr   error
+		wg                     sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		clientConn, clientErr = yrgourd.Initiate(clientPipe, is, rs.PublicKey(), rand.Reader, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		serverConn, serverErr = yrgourd.Respond(serverPipe, rs, rand.Reader, nil, yrgourd.AllowAllPolicy)
+	}()
+	wg.Wait()
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+	}
+	return clientConn, serverConn
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	t.Fatal("timed out")
+}
@@ -0,0 +1,285 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Stream is a bidirectional, flow-controlled stream of bytes in a session. It implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu                          sync.Mutex
+	recvBuf                     bytes.Buffer
+	recvWindow, consumed        uint32
+	sendWindow                  uint32
+	localClosed, remoteClosed   bool
+	isReset                     bool
+	readDeadline, writeDeadline time.Time
+
+	recvNotify, sendNotify chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:      id,
+		session: s,
+		// The SYN or ACK frame grows the remote peer's window to our maximum.
+		recvWindow: s.maxWindow,
+		sendWindow: initialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's ID.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data from the stream. It returns io.EOF once the remote peer has closed the stream and all its data has
+// been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.isReset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+
+			// Once half the window has been read, let the remote peer send more.
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= st.session.maxWindow/2 {
+				update, st.consumed = st.consumed, 0
+				st.recvWindow += update
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				_ = st.session.sendControl(typeWindowUpdate, 0, st.id, update)
+			}
+			return n, nil
+		}
+
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, waiting for the remote peer to grant a large enough window.
+func (st *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.isReset {
+			st.mu.Unlock()
+			return n, ErrStreamReset
+		}
+
+		if st.localClosed {
+			st.mu.Unlock()
+			return n, ErrStreamClosed
+		}
+
+		// Wait for the remote peer to grow our window.
+		chunk := min(len(p), int(st.sendWindow), st.session.maxData())
+		if chunk == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		st.sendWindow -= uint32(chunk)
+		st.mu.Unlock()
+
+		msg := appendHeader(make([]byte, 0, headerLen+chunk), typeData, 0, st.id, 0)
+		if err := st.session.sendData(append(msg, p[:chunk]...)); err != nil {
+			return n, err
+		}
+		n += chunk
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// Close half-closes the stream: the remote peer reads io.EOF once it has read all the data written, but data may still
+// be read from the stream until the remote peer closes it as well.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.isReset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+
+	_ = st.session.sendControl(typeData, flagFIN, st.id, 0)
+	st.notify()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return nil
+}
+
+// Reset abruptly closes the stream in both directions, discarding any unread data.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.isReset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.mu.Unlock()
+
+	_ = st.session.sendControl(typeWindowUpdate, flagRST, st.id, 0)
+	st.reset()
+	return nil
+}
+
+// LocalAddr returns the local peer's address.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.Addr()
+}
+
+// RemoteAddr returns the remote peer's address.
+func (st *Stream) RemoteAddr() net.Addr {
+	return Addr{Key: st.session.conn.RemoteKey()}
+}
+
+// SetDeadline sets the read and write deadlines.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+
+	st.notify()
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	st.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.notify()
+	return nil
+}
+
+// receive buffers data from the remote peer, returning false if it exceeds the stream's window.
+func (st *Stream) receive(data []byte) bool {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+	st.recvBuf.Write(data)
+	st.mu.Unlock()
+
+	st.notify()
+	return true
+}
+
+// grow grows the stream's send window.
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow = uint32(min(uint64(st.sendWindow)+uint64(n), maxWindow))
+	st.mu.Unlock()
+
+	st.notify()
+}
+
+// remoteClose records that the remote peer has closed the stream.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+
+	st.notify()
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+// reset records that the stream has been reset, discarding any unread data.
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.isReset = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+
+	st.notify()
+	st.session.removeStream(st.id)
+}
+
+// abort resets the stream and tells the remote peer.
+func (st *Stream) abort() {
+	_ = st.session.sendControl(typeWindowUpdate, flagRST, st.id, 0)
+	st.reset()
+}
+
+// notify wakes any pending reads and writes.
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.recvNotify, st.sendNotify} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait waits for a notification, the deadline, or the session to shut down.
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.shutdown:
+		return st.session.err()
+	}
+}
@@ -0,0 +1,83 @@
+package yrgourd
+
+import (
+	mrand "math/rand/v2"
+	"slices"
+)
+
+// Although the contents of each frame are encrypted, the length of each frame is visible on the wire, which can leak
+// the sizes of application messages. If both peers support FeaturePadding and the sender has configured a
+// PaddingPolicy, the sender pads the body of each frame before sealing it and sets the padded bit in the frame type. A
+// padded body consists of:
+//
+//	content length (3 bytes) || content || padding
+//
+// Because the padding is sealed along with the content, it is authenticated, and the receiver strips it transparently.
+
+// A PaddingPolicy returns the length to which a frame's content of length n should be padded. Returned lengths shorter
+// than n are ignored, and padded frames are truncated to the remote peer's maximum frame size.
+type PaddingPolicy func(n int) int
+
+// PadToBuckets returns a PaddingPolicy which pads each frame to the smallest of the given sizes that fits it. Frames
+// larger than all the sizes are not padded.
+func PadToBuckets(sizes ...int) PaddingPolicy {
+	sizes = slices.Clone(sizes)
+	slices.Sort(sizes)
+	return func(n int) int {
+		for _, size := range sizes {
+			if n <= size {
+				return size
+			}
+		}
+		return n
+	}
+}
+
+// PadToBlock returns a PaddingPolicy which pads each frame to a multiple of the given block size.
+func PadToBlock(size int) PaddingPolicy {
+	return func(n int) int {
+		if size <= 0 {
+			return n
+		}
+		return (n + size - 1) / size * size
+	}
+}
+
+// RandomPadding returns a PaddingPolicy which pads each frame with up to max bytes of random length.
+func RandomPadding(max int) PaddingPolicy {
+	return func(n int) int {
+		if max <= 0 {
+			return n
+		}
+		return n + mrand.IntN(max+1)
+	}
+}
+
+// pad appends the padded form of body to dst, padding the content to at most limit bytes.
+func pad(dst, body []byte, policy PaddingPolicy, limit int) []byte {
+	padded := min(max(policy(len(body)), len(body)), limit-paddedHeaderLen)
+	dst = append(dst, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	dst = append(dst, body...)
+	return append(dst, make([]byte, padded-len(body))...)
+}
+
+// unpad returns the content of a padded body.
+func unpad(body []byte) ([]byte, error) {
+	if len(body) < paddedHeaderLen {
+		return nil, ErrInvalidFrame
+	}
+
+	n := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+	if n > len(body)-paddedHeaderLen {
+		return nil, ErrInvalidFrame
+	}
+	return body[paddedHeaderLen : paddedHeaderLen+n], nil
+}
+
+const (
+	// framePadded is the bit set in the frame type of padded frames.
+	framePadded byte = 0x80
+
+	// 3-byte content length
+	paddedHeaderLen = 3
+)
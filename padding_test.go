@@ -0,0 +1,100 @@
+package yrgourd
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	buckets := PadToBuckets(1024, 256, 4096)
+	for n, want := range map[int]int{0: 256, 256: 256, 257: 1024, 4000: 4096, 5000: 5000} {
+		if got := buckets(n); got != want {
+			t.Errorf("PadToBuckets(%d) = %d, want %d", n, got, want)
+		}
+	}
+
+	block := PadToBlock(512)
+	for n, want := range map[int]int{0: 0, 1: 512, 512: 512, 513: 1024} {
+		if got := block(n); got != want {
+			t.Errorf("PadToBlock(%d) = %d, want %d", n, got, want)
+		}
+	}
+
+	random := RandomPadding(100)
+	for range 100 {
+		if got := random(10); got < 10 || got > 110 {
+			t.Errorf("RandomPadding(10) = %d, want 10..110", got)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	client, server := testConnPair(t, nil, nil)
+
+	// Pad the client's frames and record their sizes on the wire.
+	client.padding = PadToBlock(256)
+	w := &writeRecorder{ReadWriter: client.rw}
+	client.rw = w
+
+	messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte("a"), 1000)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, m := range messages {
+			if _, err := client.Write(m); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for _, want := range messages {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("expected %q but was %q", want, got)
+		}
+	}
+	<-done
+
+	for i, m := range messages {
+		padded := (len(m) + 255) / 256 * 256
+		if got, want := w.sizes[i], frameHeaderLen+paddedHeaderLen+padded+lockstitch.TagLen; got != want {
+			t.Errorf("expected a %d-byte frame but was %d", want, got)
+		}
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	body := pad(nil, []byte("hello"), PadToBlock(64), 1024)
+	if got, err := unpad(body); err != nil || string(got) != "hello" {
+		t.Errorf("expected %q but was %q/%v", "hello", got, err)
+	}
+
+	// Padding is truncated to the frame size limit.
+	if body := pad(nil, []byte("hello"), PadToBlock(4096), 1024); len(body) != 1024 {
+		t.Errorf("expected a 1024-byte body but was %d", len(body))
+	}
+
+	for _, body := range [][]byte{{0, 0}, {0, 0, 6, 'h', 'e', 'l', 'l', 'o'}} {
+		if _, err := unpad(body); err != ErrInvalidFrame {
+			t.Errorf("expected %v but was %v", ErrInvalidFrame, err)
+		}
+	}
+}
+
+// writeRecorder records the sizes of the writes to an underlying ReadWriter.
+type writeRecorder struct {
+	io.ReadWriter
+	sizes []int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return w.ReadWriter.Write(p)
+}
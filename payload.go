@@ -0,0 +1,60 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+// The initiator's early data and the responder's response data are sealed with the label "payload". Each peer
+// announces the length of its payload, if any, in its extension data, so the payloads are only sent when non-empty.
+
+// setPayloadLen sets the length of the payload which follows the extensions.
+func (e *extensions) setPayloadLen(n int) {
+	if n == 0 {
+		return
+	}
+
+	e.set(extPayloadLen, binary.BigEndian.AppendUint16(nil, uint16(n)))
+}
+
+// payloadLen returns the length of the payload which follows the extensions.
+func (e *extensions) payloadLen() (int, error) {
+	b, ok := e.data[extPayloadLen]
+	if !ok {
+		return 0, nil
+	}
+
+	if len(b) != 2 {
+		return 0, ErrInvalidHandshake
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+// sealPayload appends the sealed payload, if any, to dst.
+func sealPayload(yr *lockstitch.Protocol, dst, payload []byte) []byte {
+	if len(payload) == 0 {
+		return dst
+	}
+	return yr.Seal("payload", dst, payload)
+}
+
+// readPayload reads and opens the payload announced in the peer's extensions, if any.
+func readPayload(r io.Reader, yr *lockstitch.Protocol, peer *extensions) ([]byte, error) {
+	n, err := peer.payloadLen()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	payload := make([]byte, n+lockstitch.TagLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	payload, err = yr.Open("payload", payload[:0], payload)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	return payload, nil
+}
@@ -0,0 +1,98 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHandshakePayloads(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	earlyData := []byte("service=echo")
+	responseData := bytes.Repeat([]byte("ok"), 1000)
+
+	for _, test := range []struct {
+		name     string
+		initiate func(rw io.ReadWriter, config *Config) (*Conn, error)
+	}{
+		{"standard", func(rw io.ReadWriter, config *Config) (*Conn, error) {
+			return Initiate(rw, is, rs.PublicKey(), rand.Reader, config)
+		}},
+		{"discover", func(rw io.ReadWriter, config *Config) (*Conn, error) {
+			return initiateDiscover(rw, is, rand.Reader, config, func(key *PublicKey) error { return nil })
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, hybrid := range []bool{false, true} {
+				var policyData []byte
+				client, server, clientErr, serverErr := testHandshake(t,
+					func(rw io.ReadWriter) (*Conn, error) {
+						return test.initiate(rw, &Config{EarlyData: earlyData, Hybrid: hybrid})
+					},
+					func(rw io.ReadWriter) (*Conn, error) {
+						return Respond(rw, rs, rand.Reader, &Config{ResponseData: responseData, Hybrid: hybrid, AllowDiscovery: true}, func(key *PublicKey, earlyData []byte) bool {
+							policyData = earlyData
+							return true
+						})
+					},
+				)
+				if clientErr != nil || serverErr != nil {
+					t.Fatalf("handshake failed: %v/%v", clientErr, serverErr)
+				}
+
+				if !bytes.Equal(earlyData, policyData) {
+					t.Errorf("expected policy to receive %q but was %q", earlyData, policyData)
+				}
+
+				if !bytes.Equal(earlyData, server.EarlyData()) {
+					t.Errorf("expected early data %q but was %q", earlyData, server.EarlyData())
+				}
+
+				if !bytes.Equal(responseData, client.ResponseData()) {
+					t.Errorf("expected response data %q but was %q", responseData, client.ResponseData())
+				}
+
+				// Make sure both peers still agree on the connection state.
+				serverSend := server.send.Derive("a", nil, 8)
+				clientRecv := client.recv.Derive("a", nil, 8)
+				if !bytes.Equal(serverSend, clientRecv) {
+					t.Errorf("expected serverSend == clientRecv, but was %v/%v", serverSend, clientRecv)
+				}
+			}
+		})
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		_, _, _, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Initiate(rw, is, rs.PublicKey(), rand.Reader, &Config{EarlyData: []byte("service=admin")})
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, nil, func(key *PublicKey, earlyData []byte) bool {
+					return bytes.Equal(earlyData, []byte("service=echo"))
+				})
+			},
+		)
+		if !errors.Is(serverErr, ErrInitiatorNotAllowed) {
+			t.Errorf("expected %v but was %v", ErrInitiatorNotAllowed, serverErr)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		_, err := Initiate(nil, is, rs.PublicKey(), rand.Reader, &Config{EarlyData: make([]byte, MaxPayloadLen+1)})
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("expected %v but was %v", ErrPayloadTooLarge, err)
+		}
+	})
+}
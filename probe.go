@@ -0,0 +1,85 @@
+package yrgourd
+
+import (
+	"bytes"
+	"io"
+	mrand "math/rand/v2"
+	"time"
+)
+
+// ProbeResistance configures a responder to resist active probing. An adversary who doesn't know the responder's
+// static public key can't produce a valid request, but can still send data and observe how the responder reacts:
+// closing the connection as soon as a fixed number of bytes has been received, or responding with fixed-size messages,
+// would identify it as a yrgourd responder.
+//
+// With probe resistance enabled, a responder which fails a handshake for any reason keeps reading and discarding data
+// for a random amount of time and a random number of bytes before returning, or hands the connection to a decoy
+// handler. This includes rejected resumption tickets, as anyone who recorded a resumption request can replay it once the
+// ticket has expired. An initiator whose ticket is rejected only finds out once the responder stops discarding data, so
+// initiators should bound their handshakes with a deadline. Handshake messages are padded with a random number of
+// bytes. Discovery handshakes, which reveal the responder's static public key to anyone who asks, are refused unless a
+// pre-shared key is configured.
+type ProbeResistance struct {
+	// MaxDiscardTime is the maximum amount of time a responder spends discarding data after a failed handshake. The
+	// actual time is chosen at random. If zero, it is 30 seconds. It is only enforced if the connection has a
+	// SetReadDeadline method.
+	MaxDiscardTime time.Duration
+
+	// MaxDiscardBytes is the maximum number of bytes a responder discards after a failed handshake. The actual number
+	// is chosen at random. If zero, it is 64KiB.
+	MaxDiscardBytes int
+
+	// Decoy, if set, is called instead of discarding data after a failed handshake. It is passed a ReadWriter which
+	// returns all the data read during the handshake followed by the rest of the connection's data, so it can act as,
+	// e.g., an HTTP server. Respond returns the handshake error once Decoy returns.
+	Decoy func(rw io.ReadWriter)
+
+	// MaxPadding is the maximum number of bytes of padding added to each of the peer's handshake messages. The actual
+	// amount is chosen at random for each message. Padding is capped at 16KiB.
+	MaxPadding int
+}
+
+// fail handles a failed handshake on a connection.
+func (pr *ProbeResistance) fail(rw io.ReadWriter, read []byte) {
+	if pr.Decoy != nil {
+		pr.Decoy(struct {
+			io.Reader
+			io.Writer
+		}{io.MultiReader(bytes.NewReader(read), rw), rw})
+		return
+	}
+
+	maxTime := pr.MaxDiscardTime
+	if maxTime <= 0 {
+		maxTime = defaultMaxDiscardTime
+	}
+
+	maxBytes := pr.MaxDiscardBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxDiscardBytes
+	}
+
+	if d, ok := rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = d.SetReadDeadline(time.Now().Add(mrand.N(maxTime)))
+	}
+	_, _ = io.CopyN(io.Discard, rw, int64(mrand.IntN(maxBytes)))
+}
+
+// recordingReader records everything read from a ReadWriter during a handshake. newConnection unwraps it, so that an
+// established connection and its background tasks only ever use the underlying ReadWriter.
+type recordingReader struct {
+	io.ReadWriter
+	buf bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadWriter.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+const (
+	defaultMaxDiscardTime  = 30 * time.Second
+	defaultMaxDiscardBytes = 64 * 1024
+	maxPadding             = 16 * 1024
+)
@@ -0,0 +1,151 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProbeResistance(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 10)
+
+	t.Run("decoy", func(t *testing.T) {
+		var got []byte
+		config := &Config{ProbeResistance: &ProbeResistance{
+			Decoy: func(rw io.ReadWriter) {
+				got, _ = io.ReadAll(rw)
+				_, _ = io.WriteString(rw, "HTTP/1.1 404 Not Found\r\n\r\n")
+			},
+		}}
+
+		rec := &recorder{r: bytes.NewReader(probe)}
+		if _, err := Respond(rec, rs, rand.Reader, config, AllowAllPolicy); !errors.Is(err, ErrInvalidHandshake) {
+			t.Errorf("expected %v but was %v", ErrInvalidHandshake, err)
+		}
+
+		if !bytes.Equal(got, probe) {
+			t.Errorf("expected decoy to read %q but was %q", probe, got)
+		}
+
+		if got, want := rec.w.String(), "HTTP/1.1 404 Not Found\r\n\r\n"; got != want {
+			t.Errorf("expected %q but was %q", want, got)
+		}
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		const maxDiscard = 1000
+		config := &Config{ProbeResistance: &ProbeResistance{MaxDiscardBytes: maxDiscard}}
+
+		r := bytes.NewReader(append(probe, make([]byte, 10*maxDiscard)...))
+		if _, err := Respond(&recorder{r: r}, rs, rand.Reader, config, AllowAllPolicy); !errors.Is(err, ErrInvalidHandshake) {
+			t.Errorf("expected %v but was %v", ErrInvalidHandshake, err)
+		}
+
+		// The responder reads up to a version 1 request before discarding.
+		if n := r.Size() - int64(r.Len()); n > v1ReqLen+maxDiscard {
+			t.Errorf("expected at most %d bytes to be read but was %d", v1ReqLen+maxDiscard, n)
+		}
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		config := &Config{AllowDiscovery: true, ProbeResistance: &ProbeResistance{MaxDiscardBytes: 1}}
+		_, _, _, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return initiateDiscover(rw, is, rand.Reader, nil, func(*PublicKey) error { return nil })
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, config, AllowAllPolicy)
+			})
+		if !errors.Is(serverErr, ErrInvalidHandshake) {
+			t.Errorf("expected %v but was %v", ErrInvalidHandshake, serverErr)
+		}
+	})
+
+	t.Run("padding", func(t *testing.T) {
+		config := &Config{ProbeResistance: &ProbeResistance{MaxPadding: 1024}}
+
+		// Padded requests vary in size.
+		sizes := make(map[int]bool)
+		for range 10 {
+			rec := &recorder{}
+			_, _ = Initiate(rec, is, rs.PublicKey(), rand.Reader, config)
+			sizes[rec.w.Len()] = true
+		}
+		if len(sizes) < 2 {
+			t.Errorf("expected padded requests to vary in size but were %v", sizes)
+		}
+
+		// Padded handshakes succeed.
+		client, server := testConnect(t, is, rs, config, config)
+		if !client.RemoteKey().Equal(rs.PublicKey()) || !server.RemoteKey().Equal(is.PublicKey()) {
+			t.Error("unexpected keys")
+		}
+	})
+
+	t.Run("background tasks", func(t *testing.T) {
+		// Connections start sending keepalives as soon as the handshake completes, which must not race with the
+		// responder's handling of probe resistance.
+		config := &Config{ProbeResistance: &ProbeResistance{}, KeepaliveInterval: time.Millisecond}
+		client, server := testConnPair(t, config, config)
+
+		go func() {
+			_, _ = io.Copy(io.Discard, client)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := server.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("rejected ticket", func(t *testing.T) {
+		clientConfig := &Config{SessionCache: NewSessionCache(1)}
+		serverConfig := &Config{TicketKeys: NewTicketKeys(rand.Reader), ProbeResistance: &ProbeResistance{}}
+		client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.Close()
+		}()
+		if _, err := io.ReadAll(client); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		// A rejected ticket is handled like any other failed handshake, as the request may be a replay.
+		decoyed := false
+		serverConfig.ProbeResistance.Decoy = func(io.ReadWriter) {
+			decoyed = true
+		}
+		serverConfig.TicketLifetime = time.Nanosecond
+		_, _, clientErr, serverErr := testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Initiate(rw, is, rs.PublicKey(), rand.Reader, clientConfig)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, serverConfig, AllowAllPolicy)
+			})
+		if !errors.Is(serverErr, ErrTicketRejected) {
+			t.Errorf("expected %v but was %v", ErrTicketRejected, serverErr)
+		}
+		if !errors.Is(clientErr, ErrTicketRejected) {
+			t.Errorf("expected %v but was %v", ErrTicketRejected, clientErr)
+		}
+		if !decoyed {
+			t.Error("expected the rejected ticket to be handed to the decoy")
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// ratchetTimer ratchets a connection's send direction whenever RatchetAfterTime passes without a ratchet, so that idle
+// connections keep the same forward secrecy window as busy ones.
+type ratchetTimer struct {
+	quit, exited chan struct{}
+	stopOnce     sync.Once
+}
+
+// newRatchetTimer returns a ratchet timer, or nil if background ratcheting is disabled.
+func newRatchetTimer(config *Config) *ratchetTimer {
+	if !config.RatchetInBackground || config.RatchetAfterTime <= 0 {
+		return nil
+	}
+
+	return &ratchetTimer{
+		quit:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+}
+
+// ratchetPeriodically ratchets the connection whenever it hasn't been ratcheted for RatchetAfterTime, until the timer
+// is stopped or a ratchet fails.
+func (c *Conn) ratchetPeriodically() {
+	t := c.ratchetTimer
+	defer close(t.exited)
+
+	timer := time.NewTimer(c.untilRatchet())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-timer.C:
+		}
+
+		// Writes may have ratcheted the connection since the timer was set.
+		if c.untilRatchet() <= 0 {
+			if err := c.ratchet(); err != nil {
+				return
+			}
+		}
+		timer.Reset(c.untilRatchet())
+	}
+}
+
+// untilRatchet returns the time until the connection is due to be ratcheted.
+func (c *Conn) untilRatchet() time.Duration {
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
+	return c.ratchetAfterTime - time.Since(c.lastRatchet)
+}
+
+// stop stops the timer and waits for it to exit.
+func (t *ratchetTimer) stop() {
+	t.stopOnce.Do(func() {
+		close(t.quit)
+	})
+	<-t.exited
+}
+
+// ratchetKeys are the ephemeral keys used to ratchet a connection when both peers support FeatureEphemeralRatchet.
+//
+// Each peer has a sequence of ratchet keys, numbered by generation, starting with the initial ratchet key it sent in its
+// handshake extensions. The initial ratchet keys are separate from the handshake ephemeral keys, so the ephemeral keys
+// can be discarded as soon as the handshake is complete. To ratchet, a peer generates a new ratchet key and sends a
+// ratchet frame containing the generation of the remote peer's latest ratchet key it has received, the generation of
+// its new key, and its new public key:
+//
+//	remote generation (8 bytes) || local generation (8 bytes) || public key (65 bytes)
+//
+// Both peers mix the ephemeral-ephemeral shared secret of the two keys into the sender's direction. Because a peer
+// always uses the latest key it has received, the remote peer can discard all of its keys older than the one used.
+type ratchetKeys struct {
+	mu        sync.Mutex
+	local     map[uint64]*PrivateKey
+	localGen  uint64
+	remote    *PublicKey
+	remoteGen uint64
+}
+
+// newRatchetKeys returns ratchet keys starting with the peers' initial ratchet keys.
+func newRatchetKeys(local *PrivateKey, remote *PublicKey) *ratchetKeys {
+	return &ratchetKeys{
+		local:  map[uint64]*PrivateKey{0: local},
+		remote: remote,
+	}
+}
+
+// send makes the given key the local peer's latest ratchet key and returns the ratchet frame body and the shared
+// secret.
+func (k *ratchetKeys) send(ephemeral *PrivateKey) (body, ss []byte, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	ss, err = ephemeral.ECDH(k.remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k.localGen++
+	k.local[k.localGen] = ephemeral
+
+	// If the remote peer isn't ratcheting, don't keep keys indefinitely.
+	delete(k.local, k.localGen-maxRatchetKeys)
+
+	body = make([]byte, 0, ratchetFrameLen)
+	body = binary.BigEndian.AppendUint64(body, k.remoteGen)
+	body = binary.BigEndian.AppendUint64(body, k.localGen)
+	body = append(body, ephemeral.PublicKey().Bytes()...)
+	return body, ss, nil
+}
+
+// receive records the remote peer's new ratchet key from a ratchet frame body and returns the shared secret.
+func (k *ratchetKeys) receive(body []byte) ([]byte, error) {
+	if len(body) != ratchetFrameLen {
+		return nil, ErrInvalidFrame
+	}
+
+	used, gen := binary.BigEndian.Uint64(body), binary.BigEndian.Uint64(body[8:])
+	ephemeral, err := NewPublicKey(body[16:])
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	local, ok := k.local[used]
+	if !ok {
+		return nil, ErrInvalidFrame
+	}
+
+	ss, err := local.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	// The remote peer will never use older keys again.
+	for g := range k.local {
+		if g < used {
+			delete(k.local, g)
+		}
+	}
+
+	if gen > k.remoteGen {
+		k.remote, k.remoteGen = ephemeral, gen
+	}
+	return ss, nil
+}
+
+const (
+	// remote generation + local generation + public key
+	ratchetFrameLen = 8 + 8 + pointLen
+	// the number of the local peer's ratchet keys retained for a remote peer which isn't ratcheting
+	maxRatchetKeys = 256
+)
@@ -0,0 +1,97 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestEphemeralRatchet(t *testing.T) {
+	t.Run("ephemeral", func(t *testing.T) {
+		client, server := testConnPair(t, nil, nil)
+		if client.ratchetKeys == nil || server.ratchetKeys == nil {
+			t.Fatal("expected ephemeral ratchets to be negotiated")
+		}
+
+		// Each peer starts with the initial ratchet key the other sent in its extensions.
+		if !client.ratchetKeys.local[0].PublicKey().Equal(server.ratchetKeys.remote) ||
+			!server.ratchetKeys.local[0].PublicKey().Equal(client.ratchetKeys.remote) {
+			t.Error("initial ratchet key mismatch")
+		}
+		testBidirectionalRatchets(t, client, server)
+
+		// Keys which the remote peer will no longer use are discarded.
+		k := client.ratchetKeys
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if n := len(k.local); uint64(n) > k.localGen {
+			t.Errorf("expected fewer than %d retained keys but was %d", k.localGen+1, n)
+		}
+	})
+
+	t.Run("static", func(t *testing.T) {
+		client, server := testConnPair(t, nil, nil)
+		client.ratchetKeys, server.ratchetKeys = nil, nil
+		testBidirectionalRatchets(t, client, server)
+	})
+
+	t.Run("unknown generation", func(t *testing.T) {
+		ephemeral, err := GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sender := newRatchetKeys(ephemeral, ephemeral.PublicKey())
+		sender.remoteGen = 10
+		body, _, err := sender.send(ephemeral)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver := newRatchetKeys(ephemeral, ephemeral.PublicKey())
+		if _, err := receiver.receive(body); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("expected %v but was %v", ErrInvalidFrame, err)
+		}
+	})
+}
+
+// testBidirectionalRatchets has both peers ratchet and write concurrently, and checks that everything arrives intact.
+func testBidirectionalRatchets(t *testing.T, client, server *Conn) {
+	t.Helper()
+
+	message := bytes.Repeat([]byte("a"), 100)
+	wg := new(sync.WaitGroup)
+	for _, c := range []*Conn{client, server} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := c.Ratchet(); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := c.Write(message); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			got := make([]byte, len(message))
+			for range 20 {
+				if _, err := io.ReadFull(c, got); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, message) {
+					t.Error("message mismatch")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
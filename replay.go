@@ -0,0 +1,82 @@
+package yrgourd
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrReplayedHandshake = errors.New("yrgourd: replayed handshake")
+
+// A ReplayCache allows a responder to reject replayed handshake requests. Each request carries a timestamp inside its
+// sealed extensions; the responder rejects requests whose timestamps are more than Window away from its own clock, and
+// remembers the encoded ephemeral public keys of accepted requests until their timestamps fall out of the window, so
+// that duplicates are rejected as well. The window must accommodate clock skew between initiators and the responder.
+//
+// A ReplayCache only applies to requests for a known responder key. Discovery requests are not checked, as a replayed
+// discovery request cannot be completed without the initiator's ephemeral private key.
+//
+// A ReplayCache is safe for concurrent use and may be shared between responders.
+type ReplayCache struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	seen      map[[elligatorPointLen]byte]time.Time
+	nextPrune time.Time
+}
+
+// NewReplayCache returns a ReplayCache which accepts requests with timestamps within the given window of the local
+// clock.
+func NewReplayCache(window time.Duration) *ReplayCache {
+	return &ReplayCache{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[[elligatorPointLen]byte]time.Time),
+	}
+}
+
+// check returns ErrReplayedHandshake if the timestamp is outside the window or if the encoded ephemeral public key has
+// already been seen. Otherwise, it remembers the key until the timestamp falls out of the window.
+func (c *ReplayCache) check(ie []byte, timestamp time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expiry := timestamp.Add(c.window)
+	if now.After(expiry) || timestamp.After(now.Add(c.window)) {
+		return ErrReplayedHandshake
+	}
+
+	// Periodically forget keys whose timestamps are out of the window.
+	if now.After(c.nextPrune) {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.nextPrune = now.Add(c.window)
+	}
+
+	key := [elligatorPointLen]byte(ie)
+	if _, ok := c.seen[key]; ok {
+		return ErrReplayedHandshake
+	}
+	c.seen[key] = expiry
+	return nil
+}
+
+// setTimestamp sets the timestamp of the request.
+func (e *extensions) setTimestamp(t time.Time) {
+	e.set(extTimestamp, binary.BigEndian.AppendUint64(nil, uint64(t.UnixMilli())))
+}
+
+// timestamp returns the timestamp of the request, if any.
+func (e *extensions) timestamp() (time.Time, bool) {
+	b, ok := e.data[extTimestamp]
+	if !ok || len(b) != 8 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(b))), true
+}
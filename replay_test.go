@@ -0,0 +1,93 @@
+package yrgourd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record a request.
+	rec := &recorder{}
+	if _, err := Initiate(rec, is, rs.PublicKey(), rand.Reader, nil); err == nil {
+		t.Fatal("should not have initiated")
+	}
+
+	replay := func(config *Config) error {
+		_, err := Respond(&recorder{r: bytes.NewReader(rec.w.Bytes())}, rs, rand.Reader, config, AllowAllPolicy)
+		return err
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		for range 2 {
+			if err := replay(nil); err != nil {
+				t.Errorf("expected replay to be accepted but was %v", err)
+			}
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		config := &Config{ReplayCache: NewReplayCache(time.Minute)}
+		if err := replay(config); err != nil {
+			t.Errorf("expected request to be accepted but was %v", err)
+		}
+
+		if err := replay(config); !errors.Is(err, ErrReplayedHandshake) {
+			t.Errorf("expected %v but was %v", ErrReplayedHandshake, err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		cache := NewReplayCache(time.Minute)
+		cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		if err := replay(&Config{ReplayCache: cache}); !errors.Is(err, ErrReplayedHandshake) {
+			t.Errorf("expected %v but was %v", ErrReplayedHandshake, err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		cache := NewReplayCache(time.Minute)
+		if err := cache.check(rec.w.Bytes()[:elligatorPointLen], time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Keys are forgotten once their timestamps leave the window.
+		cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		if err := cache.check(make([]byte, elligatorPointLen), time.Now().Add(2*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cache.seen); n != 1 {
+			t.Errorf("expected 1 remembered key but was %d", n)
+		}
+	})
+}
+
+// recorder records writes and serves reads from r, if any.
+type recorder struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	if r.r == nil {
+		return 0, io.EOF
+	}
+	return r.r.Read(p)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	return r.w.Write(p)
+}
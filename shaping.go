@@ -0,0 +1,144 @@
+package yrgourd
+
+import (
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shaping configures a connection to hide when traffic happens as well as how much of it there is. Instead of sending
+// frames as they are written, a shaped connection sends exactly one frame per slot, on a fixed or jittered schedule.
+// Each frame is padded to the same size. If there is no data to send when a slot comes up, the connection sends a cover
+// frame, which the remote peer authenticates and discards.
+//
+// Shaping requires both peers to support FeaturePadding and FeatureCoverTraffic. It limits the connection's throughput
+// to one slot's worth of data per interval, and writes block until their data has been sent. The connection sends cover
+// frames until it is closed, so shaped connections must always be closed.
+type Shaping struct {
+	// Interval is the time between slots.
+	Interval time.Duration
+
+	// Jitter is the maximum random delay added to each interval. If zero, slots are sent at a constant rate.
+	Jitter time.Duration
+
+	// SlotSize is the size of each frame's padded body, in bytes. If zero, it is 1KiB. It is raised to at least 256 bytes
+	// and capped at the remote peer's maximum frame size.
+	SlotSize int
+}
+
+// shapedFrame is a frame waiting for a slot.
+type shapedFrame struct {
+	frameType byte
+	body      []byte
+	after     func()
+	done      chan error
+}
+
+// shaper sends a connection's frames in fixed-size slots on a schedule.
+type shaper struct {
+	interval, jitter time.Duration
+	slotSize         int
+	queue            chan *shapedFrame
+	quit, exited     chan struct{}
+	stopOnce         sync.Once
+	err              error
+}
+
+// newShaper returns a shaper for the given configuration and remote peer's maximum frame size.
+func newShaper(s *Shaping, maxFrameSize int) *shaper {
+	slotSize := s.SlotSize
+	if slotSize <= 0 {
+		slotSize = defaultSlotSize
+	}
+
+	return &shaper{
+		interval: s.Interval,
+		jitter:   s.Jitter,
+		slotSize: min(max(slotSize, minSlotSize), maxFrameSize),
+		queue:    make(chan *shapedFrame),
+		quit:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+}
+
+// shape sends the connection's frames, or cover frames if there are none, until the shaper is stopped or a write fails.
+func (c *Conn) shape() {
+	s := c.shaper
+	defer close(s.exited)
+
+	timer := time.NewTimer(s.next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case f := <-s.queue:
+			err := c.writeSlot(f.frameType, f.body)
+			if err == nil && f.after != nil {
+				f.after()
+			}
+			f.done <- err
+			if err != nil {
+				s.err = err
+				return
+			}
+		default:
+			if err := c.writeSlot(frameCover, nil); err != nil {
+				s.err = err
+				return
+			}
+			c.stats.coverFramesSent.Add(1)
+		}
+
+		timer.Reset(s.next())
+	}
+}
+
+// send waits for a slot and sends a frame in it, calling after, if not nil, once the frame has been sent.
+func (s *shaper) send(frameType byte, body []byte, after func()) error {
+	f := &shapedFrame{frameType: frameType, body: body, after: after, done: make(chan error, 1)}
+	select {
+	case s.queue <- f:
+		return <-f.done
+	case <-s.exited:
+		if s.err != nil {
+			return s.err
+		}
+		return net.ErrClosed
+	}
+}
+
+// stop stops the shaper and waits for it to exit.
+func (s *shaper) stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+	<-s.exited
+}
+
+// next returns the time until the next slot.
+func (s *shaper) next() time.Duration {
+	if s.jitter <= 0 {
+		return s.interval
+	}
+	return s.interval + mrand.N(s.jitter+1)
+}
+
+// writeSlot pads a frame's body to fill a slot and writes it.
+func (c *Conn) writeSlot(frameType byte, body []byte) error {
+	slotSize := c.shaper.slotSize
+	c.padBuf = pad(c.padBuf[:0], body, func(int) int { return slotSize }, slotSize)
+	return c.writeRawFrame(frameType|framePadded, c.padBuf)
+}
+
+const (
+	defaultSlotSize = 1024
+	// large enough for any control frame
+	minSlotSize = 256
+)
@@ -0,0 +1,62 @@
+package yrgourd
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/codahale/lockstitch-go"
+)
+
+func TestShaping(t *testing.T) {
+	const slotSize = 512
+	config := &Config{Shaping: &Shaping{Interval: time.Millisecond, Jitter: time.Millisecond, SlotSize: slotSize}}
+	client, server := testConnPair(t, config, nil)
+
+	message := bytes.Repeat([]byte("a"), 2000)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := client.Write(message); err != nil {
+			t.Error(err)
+		}
+		if err := client.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, message) {
+		t.Error("message mismatch")
+	}
+	<-done
+
+	// All the client's frames are the same size, and empty slots are filled with cover frames.
+	sent, received := client.Stats(), server.Stats()
+	if sent.FramesSent != received.FramesReceived || sent.BytesSent != received.BytesReceived ||
+		sent.DataBytesSent != received.DataBytesReceived || sent.CoverFramesSent != received.CoverFramesReceived {
+		t.Errorf("sent %+v but received %+v", sent, received)
+	}
+
+	if want := sent.FramesSent * (frameHeaderLen + slotSize + lockstitch.TagLen); sent.BytesSent != want {
+		t.Errorf("expected %d bytes to be sent but was %d", want, sent.BytesSent)
+	}
+
+	if sent.CoverFramesSent == 0 {
+		t.Error("expected cover frames to be sent")
+	}
+
+	if sent.DataBytesSent != int64(len(message)) {
+		t.Errorf("expected %d data bytes to be sent but was %d", len(message), sent.DataBytesSent)
+	}
+
+	if o := sent.Overhead(); o <= 0 || o >= 1 {
+		t.Errorf("unexpected overhead: %v", o)
+	}
+}
@@ -0,0 +1,66 @@
+package yrgourd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters for the traffic sent and received over a connection.
+type Stats struct {
+	// FramesSent and FramesReceived are the number of frames of any type sent and received.
+	FramesSent, FramesReceived int64
+
+	// BytesSent and BytesReceived are the number of bytes written to and read from the underlying connection after the
+	// handshake, including frame headers, padding, and authentication tags.
+	BytesSent, BytesReceived int64
+
+	// DataBytesSent and DataBytesReceived are the number of bytes of application data sent and received.
+	DataBytesSent, DataBytesReceived int64
+
+	// CoverFramesSent and CoverFramesReceived are the number of cover frames sent and received (see Shaping).
+	CoverFramesSent, CoverFramesReceived int64
+
+	// RTT is the most recent round-trip time measured by a keepalive ping, or zero if none has been measured (see
+	// Config.KeepaliveInterval).
+	RTT time.Duration
+}
+
+// Overhead returns the fraction of the bytes sent which were not application data: frame headers, authentication tags,
+// control frames, padding, and cover frames.
+func (s Stats) Overhead() float64 {
+	if s.BytesSent == 0 {
+		return 0
+	}
+	return float64(s.BytesSent-s.DataBytesSent) / float64(s.BytesSent)
+}
+
+// Stats returns the connection's traffic counters. It is safe to call concurrently with Read and Write.
+func (c *Conn) Stats() Stats {
+	return Stats{
+		FramesSent:          c.stats.framesSent.Load(),
+		FramesReceived:      c.stats.framesReceived.Load(),
+		BytesSent:           c.stats.bytesSent.Load(),
+		BytesReceived:       c.stats.bytesReceived.Load(),
+		DataBytesSent:       c.stats.dataBytesSent.Load(),
+		DataBytesReceived:   c.stats.dataBytesReceived.Load(),
+		CoverFramesSent:     c.stats.coverFramesSent.Load(),
+		CoverFramesReceived: c.stats.coverFramesReceived.Load(),
+		RTT:                 c.rtt(),
+	}
+}
+
+// rtt returns the most recent round-trip time, if any.
+func (c *Conn) rtt() time.Duration {
+	if c.keepalive == nil {
+		return 0
+	}
+	return time.Duration(c.keepalive.rtt.Load())
+}
+
+// connStats are a connection's traffic counters.
+type connStats struct {
+	framesSent, framesReceived           atomic.Int64
+	bytesSent, bytesReceived             atomic.Int64
+	dataBytesSent, dataBytesReceived     atomic.Int64
+	coverFramesSent, coverFramesReceived atomic.Int64
+}
@@ -0,0 +1,524 @@
+package yrgourd
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/codahale/elligator-squared-p256"
+	"github.com/codahale/lockstitch-go"
+)
+
+// After a handshake in which both peers support FeatureTickets, the responder sends the initiator a resumption ticket
+// in a ticket frame as soon as the handshake completes. The ticket contains a resumption secret derived from the
+// completed handshake, along with the peers' static public keys, encrypted with one of the responder's ticket keys. The
+// initiator stores the ticket and the resumption secret in its SessionCache.
+//
+// When the initiator later connects to the same responder with the same static key, it uses the ticket to perform an
+// abbreviated handshake. The request is an encoded ephemeral public key followed by the ticket, which begins with a
+// random nonce and a marker derived from the nonce and the ticket key. Only the responder can recognize the marker, so
+// resumption requests are indistinguishable from random noise to anyone else. Both peers mix the ticket and the
+// resumption secret into the protocol, and the initiator's sealed extensions prove it knows the secret. The responder
+// replies with an ephemeral public key, and both peers mix in the ephemeral-ephemeral shared secret, which gives the
+// resumed connection forward secrecy. This costs each peer a single P-256 scalar multiplication in addition to
+// generating an ephemeral key pair.
+//
+// Tickets are single-use: the initiator removes a ticket from its cache when it uses it, and the responder issues a new
+// ticket on every connection. If the responder rejects a ticket, the handshake fails with ErrTicketRejected and the
+// initiator must reconnect, which will perform a full handshake. Dialer does this automatically. A responder which no
+// longer has the key which encrypted a ticket can't recognize it, and treats the request as an invalid handshake. A
+// responder with probe resistance handles a rejected ticket like any other failed handshake (see ProbeResistance).
+//
+// Resumption isn't available for hybrid handshakes (see Config.Hybrid), as an abbreviated handshake has no ML-KEM
+// exchange.
+
+var ErrTicketRejected = errors.New("yrgourd: resumption ticket rejected")
+
+// TicketKeys holds the keys a responder uses to encrypt and decrypt resumption tickets. New tickets are encrypted with
+// the newest key, which is replaced after Config.TicketKeyRotation. Older keys are kept until every ticket they
+// encrypted has expired.
+//
+// TicketKeys is safe for concurrent use and should be shared between all the responders which accept the same tickets.
+type TicketKeys struct {
+	rand io.Reader
+
+	mu   sync.Mutex
+	keys []ticketKey // newest first
+}
+
+type ticketKey struct {
+	key     []byte
+	created time.Time
+}
+
+// NewTicketKeys returns a new set of ticket keys which are generated using the given source of randomness.
+func NewTicketKeys(rand io.Reader) *TicketKeys {
+	return &TicketKeys{rand: rand}
+}
+
+// Rotate replaces the key used to encrypt new tickets. Tickets encrypted with older keys remain valid until they expire.
+func (tk *TicketKeys) Rotate() error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	return tk.rotate(time.Now())
+}
+
+func (tk *TicketKeys) rotate(now time.Time) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(tk.rand, key); err != nil {
+		return err
+	}
+
+	tk.keys = append([]ticketKey{{key: key, created: now}}, tk.keys...)
+	return nil
+}
+
+// seal encrypts the ticket's plaintext with the newest key, rotating and pruning keys as needed.
+func (tk *TicketKeys) seal(plaintext []byte, rotation, lifetime time.Duration) ([]byte, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	now := time.Now()
+	if len(tk.keys) == 0 || now.Sub(tk.keys[0].created) > rotation {
+		if err := tk.rotate(now); err != nil {
+			return nil, err
+		}
+	}
+
+	// Forget keys which haven't encrypted any unexpired tickets.
+	for i := 1; i < len(tk.keys); i++ {
+		if now.Sub(tk.keys[i-1].created) > lifetime {
+			tk.keys = tk.keys[:i]
+			break
+		}
+	}
+
+	// The ticket starts with a random nonce and a marker which identifies the key.
+	k := tk.keys[0]
+	ticket := make([]byte, ticketNonceLen, ticketLen)
+	if _, err := io.ReadFull(tk.rand, ticket); err != nil {
+		return nil, err
+	}
+	yr := ticketProtocol(k.key, ticket)
+	ticket = yr.Derive("marker", ticket, ticketMarkerLen)
+	return yr.Seal("ticket", ticket, plaintext), nil
+}
+
+// key returns the key which issued the ticket with the given header, or nil if there is none.
+func (tk *TicketKeys) key(header []byte) []byte {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	for _, k := range tk.keys {
+		yr := ticketProtocol(k.key, header[:ticketNonceLen])
+		if subtle.ConstantTimeCompare(yr.Derive("marker", nil, ticketMarkerLen), header[ticketNonceLen:ticketHeaderLen]) == 1 {
+			return k.key
+		}
+	}
+	return nil
+}
+
+// open decrypts a ticket with the key which encrypted it.
+func (tk *TicketKeys) open(ticket []byte) ([]byte, error) {
+	if len(ticket) != ticketLen {
+		return nil, ErrTicketRejected
+	}
+
+	key := tk.key(ticket)
+	if key == nil {
+		return nil, ErrTicketRejected
+	}
+
+	yr := ticketProtocol(key, ticket[:ticketNonceLen])
+	yr.Derive("marker", nil, ticketMarkerLen)
+	plaintext, err := yr.Open("ticket", nil, ticket[ticketHeaderLen:])
+	if err != nil {
+		return nil, ErrTicketRejected
+	}
+	return plaintext, nil
+}
+
+// ticketProtocol returns a protocol for the ticket with the given key and nonce.
+func ticketProtocol(key, nonce []byte) lockstitch.Protocol {
+	yr := lockstitch.NewProtocol("yrgourd.ticket")
+	yr.Mix("key", key)
+	yr.Mix("nonce", nonce)
+	return yr
+}
+
+// A SessionCache stores the resumption tickets an initiator has received, so that later connections to the same
+// responder can use an abbreviated handshake.
+//
+// SessionCache is safe for concurrent use.
+type SessionCache struct {
+	capacity int
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	ticket []byte
+	secret []byte
+}
+
+// NewSessionCache returns a SessionCache which holds at most capacity tickets, one per pair of initiator and responder
+// static keys.
+func NewSessionCache(capacity int) *SessionCache {
+	return &SessionCache{
+		capacity: max(capacity, 1),
+		sessions: make(map[string]*session),
+	}
+}
+
+// put stores a session for the given initiator and responder static keys, replacing any existing session.
+func (sc *SessionCache) put(is, rs *PublicKey, s *session) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	k := sessionKey(is, rs)
+	if _, ok := sc.sessions[k]; !ok && len(sc.sessions) >= sc.capacity {
+		// Evict an arbitrary session to make room.
+		for k := range sc.sessions {
+			delete(sc.sessions, k)
+			break
+		}
+	}
+	sc.sessions[k] = s
+}
+
+// take removes and returns the session for the given initiator and responder static keys, if any.
+func (sc *SessionCache) take(is, rs *PublicKey) *session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	k := sessionKey(is, rs)
+	s := sc.sessions[k]
+	delete(sc.sessions, k)
+	return s
+}
+
+// sessionKey returns the cache key for the initiator and responder static keys. Anonymous initiators have a nil key.
+func sessionKey(is, rs *PublicKey) string {
+	if is == nil {
+		return string(rs.Bytes())
+	}
+	return string(is.Bytes()) + string(rs.Bytes())
+}
+
+// issueTicket returns a new ticket for the connection, or nil if one can't be issued.
+func issueTicket(c *Conn, config *Config) []byte {
+	// flags || issued || secret || rs || is
+	plaintext := make([]byte, 0, ticketPlaintextLen)
+	if c.state.Anonymous {
+		plaintext = append(plaintext, 1)
+	} else {
+		plaintext = append(plaintext, 0)
+	}
+	plaintext = binary.BigEndian.AppendUint64(plaintext, uint64(time.Now().Unix()))
+	plaintext = append(plaintext, c.resumptionSecret...)
+	plaintext = append(plaintext, CompressPublicKey(c.localKey.PublicKey())...)
+	if c.state.Anonymous {
+		plaintext = append(plaintext, make([]byte, compressedPointLen)...)
+	} else {
+		plaintext = append(plaintext, CompressPublicKey(c.remoteKey)...)
+	}
+
+	ticket, err := config.TicketKeys.seal(plaintext, ticketKeyRotation(config), ticketLifetime(config))
+	if err != nil {
+		return nil
+	}
+	return ticket
+}
+
+// openTicket decrypts and validates a ticket, returning the resumption secret, the responder's static key, and the
+// initiator's static public key, which is nil if the initiator is anonymous.
+func openTicket(ticket []byte, keys []*PrivateKey, config *Config) (secret []byte, rs *PrivateKey, is *PublicKey, err error) {
+	plaintext, err := config.TicketKeys.open(ticket)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Check the ticket's age.
+	flags, issued := plaintext[0], time.Unix(int64(binary.BigEndian.Uint64(plaintext[1:])), 0)
+	if age := time.Since(issued); age < -time.Minute || age > ticketLifetime(config) {
+		return nil, nil, nil, ErrTicketRejected
+	}
+	secret, plaintext = plaintext[9:9+resumptionSecretLen], plaintext[9+resumptionSecretLen:]
+
+	// Find the responder static key the ticket was issued for.
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(CompressPublicKey(k.PublicKey()), plaintext[:compressedPointLen]) == 1 {
+			rs = k
+			break
+		}
+	}
+	if rs == nil {
+		return nil, nil, nil, ErrTicketRejected
+	}
+
+	// Decode the initiator's static public key, unless the initiator is anonymous.
+	if flags&1 == 0 {
+		is, err = NewPublicKey(plaintext[compressedPointLen:])
+		if err != nil {
+			return nil, nil, nil, ErrTicketRejected
+		}
+	}
+	return secret, rs, is, nil
+}
+
+// initiateResume performs an abbreviated handshake using a session from a previous connection. If the initiator static
+// key is nil, the initiator is anonymous.
+func initiateResume(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, s *session, rand io.Reader, config *Config) (*Conn, error) {
+	// Generate an ephemeral key pair.
+	ie, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize a protocol and mark it as a resumption.
+	yr := newProtocol(config)
+	yr.Mix("resume", nil)
+
+	// Mix the initiator's encoded ephemeral public key and the ticket into the protocol.
+	req, err := elligator.Encode(ie.PublicKey().Bytes(), rand)
+	if err != nil {
+		return nil, err
+	}
+	yr.Mix("ie", req)
+	req = append(req, s.ticket...)
+	yr.Mix("ticket", s.ticket)
+
+	// Mix in the pre-shared key, if any, and the resumption secret.
+	mixPreSharedKey(&yr, config)
+	yr.Mix("resumption-secret", s.secret)
+
+	// Generate the initiator's initial ratchet key.
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seal the initiator's extensions, which proves we know the resumption secret.
+	local := localExtensions(config)
+	local.setPayloadLen(len(config.EarlyData))
+	local.setRatchetKey(ratchetKey.PublicKey())
+	local.setTimestamp(time.Now())
+	req = local.seal(&yr, req)
+
+	// Seal the early data, if any.
+	req = sealPayload(&yr, req, config.EarlyData)
+
+	// Send the request and read the response. If the responder rejected the ticket, it will have closed the connection.
+	if _, err := rw.Write(req); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTicketRejected, err)
+	}
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTicketRejected, err)
+	}
+
+	// Open the ciphertext and parse the responder's ephemeral public key.
+	respRE, err := yr.Open("re", resp[:0], resp)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	re, err := NewPublicKey(respRE)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	// Calculate and mix in the ephemeral-ephemeral shared secret.
+	ssIERE, err := ie.ECDH(re)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-re", ssIERE)
+
+	// Read the responder's extensions, which hold the negotiated version and features.
+	negotiated, err := readExtensions(rw, &yr)
+	if err != nil {
+		return nil, err
+	}
+	if err := local.checkReply(negotiated); err != nil {
+		return nil, err
+	}
+	remoteRatchetKey, err := negotiated.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the response data, if any.
+	responseData, err := readPayload(rw, &yr, negotiated)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the initiator is anonymous, use its initial ratchet key in place of a static key for ratcheting.
+	state := negotiated.state(negotiated, config)
+	state.Resumed = true
+	if is == nil {
+		is, state.Anonymous = ratchetKey, true
+	}
+
+	conn := newConnection(rw, &yr, true, is, rs, ratchetKey, remoteRatchetKey, rand, config, state)
+	conn.earlyData, conn.responseData = config.EarlyData, responseData
+	return conn, nil
+}
+
+// isResumeRequest returns true if the request starts with a ticket issued with one of the responder's ticket keys.
+func isResumeRequest(req []byte, config *Config) bool {
+	return config.TicketKeys.key(req[elligatorPointLen:]) != nil
+}
+
+// respondResume completes an abbreviated handshake using the initiator's ticket.
+func respondResume(rw io.ReadWriter, keys []*PrivateKey, req []byte, rand io.Reader, config *Config, policy func(key *PublicKey, earlyData []byte) bool) (*Conn, error) {
+	// Read the rest of the ticket, then decrypt and validate it.
+	reqIE := req[:elligatorPointLen]
+	ticket := make([]byte, ticketLen)
+	copy(ticket, req[elligatorPointLen:])
+	if _, err := io.ReadFull(rw, ticket[ticketHeaderLen:]); err != nil {
+		return nil, err
+	}
+	secret, rs, is, err := openTicket(ticket, keys, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize a protocol and mark it as a resumption.
+	yr := newProtocol(config)
+	yr.Mix("resume", nil)
+
+	// Mix in the initiator's encoded ephemeral public key, the ticket, the pre-shared key, if any, and the resumption
+	// secret.
+	yr.Mix("ie", reqIE)
+	yr.Mix("ticket", ticket)
+	mixPreSharedKey(&yr, config)
+	yr.Mix("resumption-secret", secret)
+
+	// Read and open the initiator's extensions, which proves the initiator knows the resumption secret.
+	peer, err := readExtensions(rw, &yr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anonymous initiators are only allowed if configured.
+	anonymous := is == nil
+	if anonymous && !config.AllowAnonymous {
+		return nil, fmt.Errorf("%w: anonymous", ErrInitiatorNotAllowed)
+	}
+
+	// If replay protection is enabled, check the request's timestamp and ephemeral public key against the cache.
+	if config.ReplayCache != nil {
+		timestamp, ok := peer.timestamp()
+		if !ok {
+			return nil, ErrInvalidHandshake
+		}
+		if err := config.ReplayCache.check(reqIE, timestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read the early data, if any.
+	earlyData, err := readPayload(rw, &yr, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the initiator's static public key and early data against the policy.
+	if !anonymous && !policy(is, earlyData) {
+		return nil, fmt.Errorf("%w: %s", ErrInitiatorNotAllowed, Fingerprint(is))
+	}
+
+	// Decode the initiator's ephemeral public key.
+	ieB, err := elligator.Decode(reqIE)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	ie, err := NewPublicKey(ieB)
+	if err != nil {
+		panic(err) // should never happen
+	}
+
+	// Generate an ephemeral key pair and seal its public key.
+	re, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	resp := yr.Seal("re", make([]byte, 0, respLen), re.PublicKey().Bytes())
+
+	// Calculate and mix in the ephemeral-ephemeral shared secret.
+	ssIERE, err := re.ECDH(ie)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-re", ssIERE)
+
+	// Read the initiator's initial ratchet key and generate the responder's.
+	remoteRatchetKey, err := peer.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seal the negotiated version and features, the responder's initial ratchet key, and the response data, if any.
+	negotiated := localExtensions(config).negotiate(peer)
+	negotiated.setPayloadLen(len(config.ResponseData))
+	negotiated.setRatchetKey(ratchetKey.PublicKey())
+	resp = negotiated.seal(&yr, resp)
+	resp = sealPayload(&yr, resp, config.ResponseData)
+
+	// Send the response.
+	if _, err := rw.Write(resp); err != nil {
+		return nil, err
+	}
+
+	// If the initiator is anonymous, use its initial ratchet key in place of a static key for ratcheting.
+	state := negotiated.state(peer, config)
+	state.Resumed = true
+	if anonymous {
+		is, state.Anonymous = remoteRatchetKey, true
+	}
+
+	conn := newConnection(rw, &yr, false, rs, is, ratchetKey, remoteRatchetKey, rand, config, state)
+	conn.earlyData, conn.responseData = earlyData, config.ResponseData
+	return conn, nil
+}
+
+// ticketLifetime returns the configured ticket lifetime, or the default.
+func ticketLifetime(config *Config) time.Duration {
+	if config.TicketLifetime <= 0 {
+		return defaultTicketLifetime
+	}
+	return config.TicketLifetime
+}
+
+// ticketKeyRotation returns the configured ticket key rotation period, or the ticket lifetime.
+func ticketKeyRotation(config *Config) time.Duration {
+	if config.TicketKeyRotation <= 0 {
+		return ticketLifetime(config)
+	}
+	return config.TicketKeyRotation
+}
+
+const (
+	defaultTicketLifetime = 24 * time.Hour
+
+	resumptionSecretLen = 32
+	ticketMarkerLen     = 16
+	// the ticket's header fills the rest of a discovery request's worth of bytes, so it can be recognized immediately
+	ticketNonceLen  = discoverReqLen - elligatorPointLen - ticketMarkerLen
+	ticketHeaderLen = ticketNonceLen + ticketMarkerLen
+	// flags + issued + secret + rs + is
+	ticketPlaintextLen = 1 + 8 + resumptionSecretLen + compressedPointLen + compressedPointLen
+	// nonce + marker + plaintext + tag
+	ticketLen = ticketHeaderLen + ticketPlaintextLen + lockstitch.TagLen
+)
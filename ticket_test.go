@@ -0,0 +1,206 @@
+package yrgourd
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestResumption(t *testing.T) {
+	rs, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticketKeys := NewTicketKeys(rand.Reader)
+	clientConfig := &Config{SessionCache: NewSessionCache(10)}
+	serverConfig := &Config{TicketKeys: ticketKeys}
+
+	// handshake connects with the shared keys and configurations, returning any errors.
+	handshake := func(t *testing.T) (clientErr, serverErr error) {
+		_, _, clientErr, serverErr = testHandshake(t,
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Initiate(rw, is, rs.PublicKey(), rand.Reader, clientConfig)
+			},
+			func(rw io.ReadWriter) (*Conn, error) {
+				return Respond(rw, rs, rand.Reader, serverConfig, AllowAllPolicy)
+			},
+		)
+		return clientErr, serverErr
+	}
+
+	// exchange has the server write to the client, delivering a ticket, and the client write back.
+	exchange := func(t *testing.T, client, server *Conn) {
+		t.Helper()
+
+		for _, pair := range [][2]*Conn{{server, client}, {client, server}} {
+			go func() {
+				if _, err := pair[0].Write([]byte("ping")); err != nil {
+					t.Errorf("write error: %v", err)
+				}
+			}()
+
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(pair[1], buf); err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+		}
+	}
+
+	t.Run("resumed", func(t *testing.T) {
+		client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+		if client.ConnectionState().Resumed {
+			t.Error("first connection should not be resumed")
+		}
+		exchange(t, client, server)
+
+		for range 3 {
+			client, server = testConnect(t, is, rs, clientConfig, serverConfig)
+
+			if !client.ConnectionState().Resumed || !server.ConnectionState().Resumed {
+				t.Error("expected connection to be resumed")
+			}
+
+			if !server.RemoteKey().Equal(is.PublicKey()) {
+				t.Error("responder has the wrong initiator key")
+			}
+			exchange(t, client, server)
+		}
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		serverConfig.AllowAnonymous = true
+		defer func() { serverConfig.AllowAnonymous = false }()
+
+		client, server := testConnect(t, nil, rs, clientConfig, serverConfig)
+		exchange(t, client, server)
+
+		client, server = testConnect(t, nil, rs, clientConfig, serverConfig)
+
+		if state := server.ConnectionState(); !state.Resumed || !state.Anonymous {
+			t.Errorf("expected an anonymous, resumed connection but was %+v", state)
+		}
+		exchange(t, client, server)
+	})
+
+	t.Run("silent responder", func(t *testing.T) {
+		client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+
+		// The server issues a ticket even if it never writes anything itself.
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.Close()
+		}()
+		if _, err := io.ReadAll(client); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ = testConnect(t, is, rs, clientConfig, serverConfig)
+		if !client.ConnectionState().Resumed {
+			t.Error("expected connection to be resumed")
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+		exchange(t, client, server)
+
+		// Expired tickets are rejected.
+		serverConfig.TicketLifetime = time.Nanosecond
+		defer func() { serverConfig.TicketLifetime = 0 }()
+
+		clientErr, serverErr := handshake(t)
+		if !errors.Is(clientErr, ErrTicketRejected) {
+			t.Errorf("expected %v but was %v", ErrTicketRejected, clientErr)
+		}
+		if !errors.Is(serverErr, ErrTicketRejected) {
+			t.Errorf("expected %v but was %v", ErrTicketRejected, serverErr)
+		}
+
+		// The ticket was used up, so the next handshake is a full one.
+		client, _ = testConnect(t, is, rs, clientConfig, serverConfig)
+		if client.ConnectionState().Resumed {
+			t.Error("expected a full handshake")
+		}
+	})
+
+	t.Run("unknown ticket key", func(t *testing.T) {
+		client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+		exchange(t, client, server)
+
+		// Tickets encrypted with forgotten keys can't be told apart from any other invalid request.
+		saved := serverConfig.TicketKeys
+		serverConfig.TicketKeys = NewTicketKeys(rand.Reader)
+		defer func() { serverConfig.TicketKeys = saved }()
+
+		clientErr, serverErr := handshake(t)
+		if !errors.Is(clientErr, ErrTicketRejected) {
+			t.Errorf("expected %v but was %v", ErrTicketRejected, clientErr)
+		}
+		if !errors.Is(serverErr, ErrInvalidHandshake) {
+			t.Errorf("expected %v but was %v", ErrInvalidHandshake, serverErr)
+		}
+	})
+
+	t.Run("hybrid", func(t *testing.T) {
+		clientConfig.Hybrid, serverConfig.Hybrid = true, true
+		defer func() { clientConfig.Hybrid, serverConfig.Hybrid = false, false }()
+
+		// Hybrid connections aren't resumed, since an abbreviated handshake has no ML-KEM exchange.
+		for range 2 {
+			client, server := testConnect(t, is, rs, clientConfig, serverConfig)
+
+			if state := client.ConnectionState(); state.Resumed || !state.Hybrid || state.Features&FeatureTickets != 0 {
+				t.Errorf("expected a hybrid connection without tickets but was %+v", state)
+			}
+			exchange(t, client, server)
+		}
+	})
+}
+
+func TestTicketKeys(t *testing.T) {
+	tk := NewTicketKeys(rand.Reader)
+	plaintext := make([]byte, ticketPlaintextLen)
+
+	ticket, err := tk.seal(plaintext, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Old keys still decrypt tickets after a rotation.
+	if err := tk.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tk.open(ticket); err != nil {
+		t.Errorf("expected ticket to open after rotation but was %v", err)
+	}
+
+	// Once the newer key is older than the ticket lifetime, the old key is forgotten.
+	tk.keys[0].created = time.Now().Add(-2 * time.Hour)
+	if _, err := tk.seal(plaintext, time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tk.open(ticket); !errors.Is(err, ErrTicketRejected) {
+		t.Errorf("expected %v but was %v", ErrTicketRejected, err)
+	}
+
+	// Tampered tickets are rejected.
+	ticket, err = tk.seal(plaintext, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket[len(ticket)-1] ^= 1
+	if _, err := tk.open(ticket); !errors.Is(err, ErrTicketRejected) {
+		t.Errorf("expected %v but was %v", ErrTicketRejected, err)
+	}
+}
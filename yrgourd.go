@@ -1,11 +1,16 @@
 package yrgourd
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/mlkem"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codahale/elligator-squared-p256"
@@ -18,6 +23,104 @@ type PublicKey = ecdh.PublicKey
 type Config struct {
 	RatchetAfterBytes int
 	RatchetAfterTime  time.Duration
+
+	// RatchetInBackground, if true, ratchets the local peer's sending direction whenever RatchetAfterTime passes
+	// without a ratchet, even if nothing is being written. Otherwise, the connection is only ratcheted when it is written
+	// to. Connections which ratchet in the background must be closed.
+	RatchetInBackground bool
+
+	// PreSharedKey is an optional 32-byte secret shared by the initiator and responder. If set, it is mixed into the
+	// handshake before anything is encrypted, so that recorded traffic remains confidential even if an adversary later
+	// breaks P-256 (e.g. with a quantum computer). Both peers must use the same key; a mismatch fails the handshake
+	// with ErrInvalidHandshake.
+	PreSharedKey []byte
+
+	// Hybrid selects the yrgourd.v2 handshake, which adds an ML-KEM-768 shared secret to the P-256 shared secrets. This
+	// protects traffic even if P-256 is broken, at the cost of ~2KiB of additional handshake traffic. Both peers must
+	// agree on the handshake version; a responder which receives a request for the other version fails the handshake
+	// with ErrHybridMismatch.
+	//
+	// The ML-KEM shared secret is only mixed in at the end of the handshake, so it covers the connection's traffic but
+	// not the contents of the handshake itself: the initiator's static public key, the early data, the response data,
+	// and, in a discovery handshake, the responder's static public key are only protected by the P-256 shared secrets
+	// and PreSharedKey, if set.
+	Hybrid bool
+
+	// MaxFrameSize is the largest frame payload, in bytes, the local peer will accept. The remote peer splits writes into
+	// frames no larger than this. If zero, the maximum frame size of 16MiB-1 is used.
+	MaxFrameSize int
+
+	// EarlyData is an optional payload of up to MaxPayloadLen bytes which the initiator sends, encrypted and
+	// authenticated, along with its static public key. The responder passes it to its policy and makes it available via
+	// Conn.EarlyData.
+	//
+	// WARNING: Early data is sent before the responder has contributed an ephemeral key. It does not have forward
+	// secrecy with respect to the responder's static key: anyone who later compromises the responder's static private
+	// key (and the pre-shared key, if any) can decrypt recorded early data. It is also not protected against replay: an
+	// attacker can resend a recorded request, causing the responder to process the early data again, even though they
+	// cannot complete the handshake. Don't send secrets in early data, and don't use it to request actions which must
+	// not be repeated.
+	EarlyData []byte
+
+	// ResponseData is an optional payload of up to MaxPayloadLen bytes which the responder sends, encrypted and
+	// authenticated, in its response. It has the same forward secrecy as the connection itself. The initiator makes it
+	// available via Conn.ResponseData.
+	ResponseData []byte
+
+	// ReplayCache, if set, is used by the responder to reject replayed handshake requests. See ReplayCache for details.
+	ReplayCache *ReplayCache
+
+	// AllowAnonymous allows the responder to accept handshakes from anonymous initiators (see InitiateAnonymous). The
+	// policy is not called for anonymous initiators.
+	AllowAnonymous bool
+
+	// AllowDiscovery allows the responder to accept handshakes from initiators which don't know its static public key
+	// (see InitiateAny), revealing the responder's primary static public key to any initiator which asks for it.
+	// Discovery requests are recognizable by anyone who sees them unless PreSharedKey is set, as they are encrypted
+	// with nothing but the initiator's ephemeral public key, so a passive observer can tell discovery handshakes apart
+	// from others.
+	AllowDiscovery bool
+
+	// TicketKeys, if set, allows the responder to issue resumption tickets and accept them for abbreviated handshakes.
+	// See TicketKeys for details. It is ignored if Hybrid is set, as resumed connections have no ML-KEM exchange.
+	TicketKeys *TicketKeys
+
+	// TicketLifetime is how long resumption tickets issued by the responder remain valid. If zero, tickets are valid for
+	// 24 hours.
+	TicketLifetime time.Duration
+
+	// TicketKeyRotation is how often the responder replaces the key which encrypts new tickets. If zero, it is equal to
+	// the ticket lifetime.
+	TicketKeyRotation time.Duration
+
+	// SessionCache, if set, stores the resumption tickets received by the initiator and uses them for abbreviated
+	// handshakes with the same responder. Like TicketKeys, it is ignored if Hybrid is set.
+	SessionCache *SessionCache
+
+	// ProbeResistance, if set, makes the responder resist active probing. See ProbeResistance for details.
+	ProbeResistance *ProbeResistance
+
+	// Padding, if set, pads the frames the local peer sends to hide the sizes of application messages. It has no effect
+	// unless the remote peer supports FeaturePadding. See PadToBuckets, PadToBlock, and RandomPadding.
+	Padding PaddingPolicy
+
+	// Shaping, if set, sends the local peer's frames in fixed-size slots on a schedule, with cover frames filling empty
+	// slots. It has no effect unless the remote peer supports FeaturePadding and FeatureCoverTraffic. See Shaping for
+	// details.
+	Shaping *Shaping
+
+	// KeepaliveInterval, if non-zero, is how long a connection may go without receiving anything before the local peer
+	// sends a ping frame, which the remote peer answers with a pong frame. This keeps idle connections from being dropped
+	// by NATs and load balancers and measures the connection's round-trip time (see Stats). Pings are only answered
+	// while the remote peer's connection is being read, and are only sent if the remote peer supports FeatureKeepalive.
+	KeepaliveInterval time.Duration
+
+	// IdleTimeout, if non-zero, is how long a connection may go without receiving anything before the remote peer is
+	// considered dead. Once it is, pending and future reads and writes return ErrIdleTimeout. It should be several times
+	// the remote peer's keepalive interval. Frames are only received while the connection is being read, so the timeout
+	// only runs while a Read or ReadMessage call is waiting for the remote peer; a connection which is only written to is
+	// never considered dead.
+	IdleTimeout time.Duration
 }
 
 var DefaultConfig = Config{
@@ -28,13 +131,44 @@ var DefaultConfig = Config{
 var (
 	ErrInvalidHandshake    = errors.New("yrgourd: invalid handshake")
 	ErrInitiatorNotAllowed = errors.New("yrgourd: initiator not allowed")
-	AllowAllPolicy         = func(key *PublicKey) bool { return true }
+	ErrResponderNotAllowed = errors.New("yrgourd: responder not allowed")
+	ErrInvalidPublicKey    = errors.New("yrgourd: invalid public key")
+	ErrNoResponderKeys     = errors.New("yrgourd: no responder keys")
+	ErrInvalidPreSharedKey = errors.New("yrgourd: invalid pre-shared key")
+	ErrInvalidFrame        = errors.New("yrgourd: invalid frame")
+	ErrUnsupportedVersion  = errors.New("yrgourd: unsupported protocol version")
+	ErrHybridMismatch      = errors.New("yrgourd: hybrid handshake mismatch")
+	ErrPayloadTooLarge     = errors.New("yrgourd: handshake payload too large")
+	ErrIdleTimeout         = errors.New("yrgourd: remote peer idle timeout")
+	ErrMessageTooLarge     = errors.New("yrgourd: message too large")
+	AllowAllPolicy         = func(key *PublicKey, earlyData []byte) bool { return true }
 )
 
+// NewPublicKey parses a P-256 public key in either uncompressed (65 bytes) or compressed (33 bytes) SEC 1 encoding.
 func NewPublicKey(key []byte) (*PublicKey, error) {
+	if len(key) == compressedPointLen {
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), key)
+		if x == nil {
+			return nil, ErrInvalidPublicKey
+		}
+
+		key = make([]byte, pointLen)
+		key[0] = 4
+		x.FillBytes(key[1:33])
+		y.FillBytes(key[33:])
+	}
 	return ecdh.P256().NewPublicKey(key)
 }
 
+// CompressPublicKey returns the 33-byte compressed SEC 1 encoding of the public key.
+func CompressPublicKey(key *PublicKey) []byte {
+	b := key.Bytes()
+	out := make([]byte, compressedPointLen)
+	out[0] = 2 | b[pointLen-1]&1
+	copy(out[1:], b[1:33])
+	return out
+}
+
 func NewPrivateKey(key []byte) (*PrivateKey, error) {
 	return ecdh.P256().NewPrivateKey(key)
 }
@@ -43,11 +177,40 @@ func GenerateKey(rand io.Reader) (*PrivateKey, error) {
 	return ecdh.P256().GenerateKey(rand)
 }
 
-func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, config *Config) (io.ReadWriter, error) {
+func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, config *Config) (*Conn, error) {
+	return initiate(rw, is, rs, rand, config)
+}
+
+// InitiateAnonymous performs a handshake with the responder without an initiator static key, similar to the Noise NK
+// pattern. The responder is authenticated, but the initiator is not; the responder must set Config.AllowAnonymous to
+// accept the handshake. Both peers report the connection as anonymous, and the responder's Conn.RemoteKey returns nil.
+func InitiateAnonymous(rw io.ReadWriter, rs *PublicKey, rand io.Reader, config *Config) (*Conn, error) {
+	return initiate(rw, nil, rs, rand, config)
+}
+
+// initiate performs a handshake with a known responder static key. If the initiator static key is nil, the initiator is
+// anonymous.
+func initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, config *Config) (*Conn, error) {
 	if config == nil {
 		config = &DefaultConfig
 	}
 
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+
+	// If we have a ticket from a previous connection to the responder, use it for an abbreviated handshake.
+	if config.SessionCache != nil && !config.Hybrid {
+		var isPub *PublicKey
+		if is != nil {
+			isPub = is.PublicKey()
+		}
+
+		if s := config.SessionCache.take(isPub, rs); s != nil {
+			return initiateResume(rw, is, rs, s, rand, config)
+		}
+	}
+
 	// Allocate a buffer for the request.
 	req := make([]byte, 0, reqLen)
 
@@ -58,7 +221,7 @@ func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, c
 	}
 
 	// Initialize a protocol.
-	yr := lockstitch.NewProtocol("yrgourd.v1")
+	yr := newProtocol(config)
 
 	// Mix the responder's static public key into the protocol.
 	yr.Mix("rs", rs.Bytes())
@@ -74,32 +237,56 @@ func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, c
 	// Calculate and mix in the ephemeral-static shared secret.
 	ssIERS, err := ie.ECDH(rs)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	yr.Mix("ie-rs", ssIERS)
 
-	// Seal the initiator's static public key.
-	req = yr.Seal("is", req, is.PublicKey().Bytes())
+	// Mix in the pre-shared key, if any.
+	mixPreSharedKey(&yr, config)
 
-	// Send the request.
-	if _, err := rw.Write(req); err != nil {
+	// Generate the initiator's initial ratchet key.
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
 		return nil, err
 	}
 
-	// Calculate and mix in the static-static shared secret.
-	ssISRS, err := is.ECDH(rs)
-	if err != nil {
-		return nil, ErrInvalidHandshake
+	// Seal the initiator's extensions.
+	anonymous := is == nil
+	local := localExtensions(config)
+	local.setPayloadLen(len(config.EarlyData))
+	local.setRatchetKey(ratchetKey.PublicKey())
+	local.setTimestamp(time.Now())
+	if anonymous {
+		local.setAnonymous()
+		local.padRequest()
+	}
+	req = local.seal(&yr, req)
+
+	if !anonymous {
+		// Seal the initiator's static public key.
+		req = yr.Seal("is", req, is.PublicKey().Bytes())
+
+		// Calculate and mix in the static-static shared secret.
+		ssISRS, err := is.ECDH(rs)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+		yr.Mix("is-rs", ssISRS)
+	}
+
+	// Seal the early data, if any.
+	req = sealPayload(&yr, req, config.EarlyData)
+
+	// Send the request.
+	if _, err := rw.Write(req); err != nil {
+		return nil, err
 	}
-	yr.Mix("is-rs", ssISRS)
 
 	// Allocate a buffer for the response.
 	resp := make([]byte, respLen)
 
 	// Read the response.
 	if _, err := io.ReadFull(rw, resp); err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -113,12 +300,14 @@ func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, c
 		return nil, ErrInvalidHandshake
 	}
 
-	// Calculate and mix in the static-ephemeral shared secret.
-	ssISREE, err := is.ECDH(re)
-	if err != nil {
-		return nil, ErrInvalidHandshake
+	// Calculate and mix in the static-ephemeral shared secret, unless the initiator is anonymous.
+	if !anonymous {
+		ssISREE, err := is.ECDH(re)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+		yr.Mix("is-re", ssISREE)
 	}
-	yr.Mix("is-re", ssISREE)
 
 	// Calculate and mix in the ephemeral-ephemeral shared secret.
 	ssIEREE, err := ie.ECDH(re)
@@ -127,77 +316,206 @@ func Initiate(rw io.ReadWriter, is *PrivateKey, rs *PublicKey, rand io.Reader, c
 	}
 	yr.Mix("ie-re", ssIEREE)
 
-	// Fork the protocol into recv and send clones.
-	recv, send := yr.Clone(), yr
-	send.Mix("sender", []byte("initiator"))
-	recv.Mix("sender", []byte("responder"))
+	// Read the responder's extensions, which hold the negotiated version and features.
+	negotiated, err := readExtensions(rw, &yr)
+	if err != nil {
+		return nil, err
+	}
+	if err := local.checkReply(negotiated); err != nil {
+		return nil, err
+	}
+	remoteRatchetKey, err := negotiated.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the response data, if any.
+	responseData, err := readPayload(rw, &yr, negotiated)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the handshake is hybrid, encapsulate a shared secret to the responder's ML-KEM key and send the ciphertext.
+	if config.Hybrid {
+		ek, err := openKEMKey(rw, &yr)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := rw.Write(sealKEMCiphertext(&yr, nil, ek)); err != nil {
+			return nil, err
+		}
+	}
+
+	// If the initiator is anonymous, use its initial ratchet key in place of a static key for ratcheting.
+	state := negotiated.state(negotiated, config)
+	if anonymous {
+		is, state.Anonymous = ratchetKey, true
+	}
+
+	conn := newConnection(rw, &yr, true, is, rs, ratchetKey, remoteRatchetKey, rand, config, state)
+	conn.earlyData, conn.responseData = config.EarlyData, responseData
+	return conn, nil
+}
 
-	return newConnection(rw, recv, send, is, rs, rand, config), nil
+func Respond(rw io.ReadWriter, rs *PrivateKey, rand io.Reader, config *Config, policy func(key *PublicKey, earlyData []byte) bool) (*Conn, error) {
+	return RespondKeys(rw, []*PrivateKey{rs}, rand, config, policy)
 }
 
-func Respond(rw io.ReadWriter, rs *PrivateKey, rand io.Reader, config *Config, policy func(key *PublicKey) bool) (io.ReadWriter, error) {
+// RespondKeys is like Respond, but accepts initiators which use any of the given responder static keys. This allows a
+// responder's static key to be rotated without coordinating with every initiator: add the new key, move initiators
+// over to it, and then remove the old key.
+//
+// The first key is the primary key, which is the key presented to initiators which don't know the responder's static
+// public key in advance. Each additional key costs an additional ECDH operation when handshaking with initiators which
+// use later keys.
+func RespondKeys(rw io.ReadWriter, keys []*PrivateKey, rand io.Reader, config *Config, policy func(key *PublicKey, earlyData []byte) bool) (*Conn, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoResponderKeys
+	}
+
 	if config == nil {
 		config = &DefaultConfig
 	}
 
-	// Initialize a protocol.
-	yr := lockstitch.NewProtocol("yrgourd.v1")
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
 
-	// Mix the responder's static public key into the protocol.
-	yr.Mix("rs", rs.PublicKey().Bytes())
+	// If probe resistance is enabled, record the handshake so that a failure can be handled without revealing anything.
+	if pr := config.ProbeResistance; pr != nil {
+		rec := &recordingReader{ReadWriter: rw}
+		conn, err := respond(rec, keys, rand, config, policy)
+		if err != nil {
+			pr.fail(rw, rec.buf.Bytes())
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	return respond(rw, keys, rand, config, policy)
+}
 
-	// Read the initiator's request.
+// respond performs the responder's side of a handshake.
+func respond(rw io.ReadWriter, keys []*PrivateKey, rand io.Reader, config *Config, policy func(key *PublicKey, earlyData []byte) bool) (*Conn, error) {
+	// Read the first part of the initiator's request, which is long enough to hold an entire discovery request.
 	req := make([]byte, reqLen)
-	if _, err := io.ReadFull(rw, req); err != nil {
+	if _, err := io.ReadFull(rw, req[:discoverReqLen]); err != nil {
 		return nil, err
 	}
 
+	// If the initiator doesn't know our static public key, perform a discovery handshake with our primary key.
+	if isDiscoverRequest(req[:discoverReqLen], config) {
+		if !config.AllowDiscovery {
+			return nil, fmt.Errorf("%w: discovery", ErrInitiatorNotAllowed)
+		}
+
+		// Discovery reveals our static public key to anyone who asks, which defeats probe resistance unless the request
+		// is bound to a pre-shared key.
+		if config.ProbeResistance != nil && config.PreSharedKey == nil {
+			return nil, ErrInvalidHandshake
+		}
+		return respondDiscover(rw, keys[0], req[:discoverReqLen], rand, config, policy)
+	}
+
+	// If the initiator has a resumption ticket, perform an abbreviated handshake.
+	if config.TicketKeys != nil && !config.Hybrid && isResumeRequest(req[:discoverReqLen], config) {
+		return respondResume(rw, keys, req[:discoverReqLen], rand, config, policy)
+	}
+
 	// Decode the initiator's ephemeral key.
-	reqIE, reqIS := req[:elligatorPointLen], req[elligatorPointLen:]
-	yr.Mix("ie", reqIE)
-	reqIE, err := elligator.Decode(reqIE)
+	reqIE, reqExt := req[:elligatorPointLen], req[elligatorPointLen:discoverReqLen]
+	ieB, err := elligator.Decode(reqIE)
 	if err != nil {
 		return nil, ErrInvalidHandshake
 	}
 
 	// Parse the initiator's ephemeral public key.
-	ie, err := NewPublicKey(reqIE)
+	ie, err := NewPublicKey(ieB)
 	if err != nil {
 		panic(err) // should never happen
 	}
 
-	// Calculate and mix in the ephemeral-static shared secret.
-	ssIERS, err := rs.ECDH(ie)
-	if err != nil {
+	// Try each of our static keys until one of them opens the initiator's extensions.
+	var (
+		yr      lockstitch.Protocol
+		rs      *PrivateKey
+		peer    *extensions
+		dataLen int
+	)
+	for _, k := range keys {
+		yr, peer, dataLen, err = openRequest(k, ie, reqIE, reqExt, config)
+		if err == nil {
+			rs = k
+			break
+		} else if errors.Is(err, ErrUnsupportedVersion) {
+			return nil, err
+		}
+	}
+	if rs == nil {
+		return nil, requestError(rw, req, keys, ie, config)
+	}
+
+	// Read the initiator's extension data, if any.
+	if err := peer.readData(rw, &yr, dataLen); err != nil {
 		return nil, err
 	}
-	yr.Mix("ie-rs", ssIERS)
 
-	// Open and decode the initiator's static public key.
-	reqIS, err = yr.Open("is", reqIS[:0], reqIS)
-	if err != nil {
-		return nil, ErrInvalidHandshake
+	// If replay protection is enabled, check the request's timestamp and ephemeral public key against the cache.
+	if config.ReplayCache != nil {
+		timestamp, ok := peer.timestamp()
+		if !ok {
+			return nil, ErrInvalidHandshake
+		}
+		if err := config.ReplayCache.check(reqIE, timestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	// Anonymous initiators don't send a static public key, and are only allowed if configured.
+	anonymous := peer.anonymous()
+	if anonymous && !config.AllowAnonymous {
+		return nil, fmt.Errorf("%w: anonymous", ErrInitiatorNotAllowed)
+	}
+
+	var is *PublicKey
+	if !anonymous {
+		// Read, open, and decode the initiator's static public key.
+		reqIS := req[discoverReqLen:]
+		if _, err := io.ReadFull(rw, reqIS); err != nil {
+			return nil, err
+		}
+		reqIS, err = yr.Open("is", reqIS[:0], reqIS)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+		is, err = NewPublicKey(reqIS)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+
+		// Calculate and mix in the static-static shared secret.
+		ssISRS, err := rs.ECDH(is)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+		yr.Mix("is-rs", ssISRS)
 	}
-	is, err := NewPublicKey(reqIS)
+
+	// Read the early data, if any.
+	earlyData, err := readPayload(rw, &yr, peer)
 	if err != nil {
-		return nil, ErrInvalidHandshake
+		return nil, err
 	}
 
-	// Check the initiator's static public key against the policy.
-	if !policy(is) {
-		return nil, ErrInitiatorNotAllowed
+	// Check the initiator's static public key and early data against the policy.
+	if !anonymous && !policy(is, earlyData) {
+		return nil, fmt.Errorf("%w: %s", ErrInitiatorNotAllowed, Fingerprint(is))
 	}
 
 	// Allocate a buffer for the response.
 	resp := make([]byte, 0, respLen)
 
-	// Calculate and mix in the static-static shared secret.
-	ssISRS, err := rs.ECDH(is)
-	if err != nil {
-		return nil, ErrInvalidHandshake
-	}
-	yr.Mix("is-rs", ssISRS)
-
 	// Generate an ephemeral key pair.
 	re, err := GenerateKey(rand)
 	if err != nil {
@@ -207,17 +525,14 @@ func Respond(rw io.ReadWriter, rs *PrivateKey, rand io.Reader, config *Config, p
 	// Seal the ephemeral public key.
 	resp = yr.Seal("re", resp[:0], re.PublicKey().Bytes())
 
-	// Send the response.
-	if _, err := rw.Write(resp); err != nil {
-		return nil, err
-	}
-
-	// Calculate and mix in the static-ephemeral shared secret.
-	ssISREE, err := re.ECDH(is)
-	if err != nil {
-		return nil, ErrInvalidHandshake
+	// Calculate and mix in the static-ephemeral shared secret, unless the initiator is anonymous.
+	if !anonymous {
+		ssISREE, err := re.ECDH(is)
+		if err != nil {
+			return nil, ErrInvalidHandshake
+		}
+		yr.Mix("is-re", ssISREE)
 	}
-	yr.Mix("is-re", ssISREE)
 
 	// Calculate and mix in the ephemeral-ephemeral shared secret.
 	ssIEREE, err := re.ECDH(ie)
@@ -226,169 +541,1071 @@ func Respond(rw io.ReadWriter, rs *PrivateKey, rand io.Reader, config *Config, p
 	}
 	yr.Mix("ie-re", ssIEREE)
 
-	// Fork the protocol into recv and send clones.
-	recv, send := yr.Clone(), yr
-	recv.Mix("sender", []byte("initiator"))
-	send.Mix("sender", []byte("responder"))
+	// Read the initiator's initial ratchet key and generate the responder's.
+	remoteRatchetKey, err := peer.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
 
-	return newConnection(rw, recv, send, rs, is, rand, config), nil
-}
+	// Seal the negotiated version and features, the responder's initial ratchet key, and the response data, if any.
+	negotiated := localExtensions(config).negotiate(peer)
+	negotiated.setPayloadLen(len(config.ResponseData))
+	negotiated.setRatchetKey(ratchetKey.PublicKey())
+	resp = negotiated.seal(&yr, resp)
+	resp = sealPayload(&yr, resp, config.ResponseData)
+
+	// If the handshake is hybrid, generate an ML-KEM key pair and seal its encapsulation key.
+	var dk *mlkem.DecapsulationKey768
+	if config.Hybrid {
+		resp, dk, err = sealKEMKey(&yr, resp, rand)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-type connection struct {
-	rw                       io.ReadWriter
-	recv                     lockstitch.Protocol
-	send                     lockstitch.Protocol
-	recvBuf, msgBuf, sendBuf []byte
-	localKey                 *PrivateKey
-	remoteKey                *PublicKey
-	rand                     io.Reader
-	sentBytes                int
-	lastRatchet              time.Time
-	ratchetAfterBytes        int
-	ratchetAfterTime         time.Duration
-}
+	// Send the response.
+	if _, err := rw.Write(resp); err != nil {
+		return nil, err
+	}
 
-func newConnection(rw io.ReadWriter, recv, send lockstitch.Protocol, localKey *PrivateKey, remoteKey *PublicKey, rand io.Reader, config *Config) io.ReadWriter {
-	return &connection{
-		rw:                rw,
-		recv:              recv,
-		send:              send,
-		localKey:          localKey,
-		remoteKey:         remoteKey,
-		rand:              rand,
-		lastRatchet:       time.Now(),
-		ratchetAfterBytes: config.RatchetAfterBytes,
-		ratchetAfterTime:  config.RatchetAfterTime,
+	// If the handshake is hybrid, read the initiator's ML-KEM ciphertext and mix in the shared secret.
+	if config.Hybrid {
+		if err := openKEMCiphertext(rw, &yr, dk); err != nil {
+			return nil, err
+		}
 	}
-}
 
-func (c *connection) Read(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return
+	// If the initiator is anonymous, use its initial ratchet key in place of a static key for ratcheting.
+	state := negotiated.state(peer, config)
+	if anonymous {
+		is, state.Anonymous = remoteRatchetKey, true
 	}
 
-	// If we still have buffered message contents, satisfy the read with that.
-	if len(c.msgBuf) > 0 {
-		n = min(len(c.msgBuf), len(p))
-		copy(p, c.msgBuf[:n])
-		c.msgBuf = c.msgBuf[n:]
-		return
+	conn := newConnection(rw, &yr, false, rs, is, ratchetKey, remoteRatchetKey, rand, config, state)
+	conn.earlyData, conn.responseData = earlyData, config.ResponseData
+	return conn, nil
+}
+
+// openRequest attempts to open a request's sealed extension header using the given responder static key.
+func openRequest(rs *PrivateKey, ie *PublicKey, reqIE, reqExt []byte, config *Config) (lockstitch.Protocol, *extensions, int, error) {
+	// Initialize a protocol.
+	yr := newProtocol(config)
+
+	// Mix the responder's static public key and the initiator's encoded ephemeral public key into the protocol.
+	yr.Mix("rs", rs.PublicKey().Bytes())
+	yr.Mix("ie", reqIE)
+
+	// Calculate and mix in the ephemeral-static shared secret.
+	ssIERS, err := rs.ECDH(ie)
+	if err != nil {
+		return yr, nil, 0, ErrInvalidHandshake
 	}
+	yr.Mix("ie-rs", ssIERS)
 
-	// Read and decrypt the header and decode the message length, if any.
-	header := allocSlice(c.recvBuf, 4+3)
-	if _, err := io.ReadFull(c.rw, header[4:]); err != nil {
-		return 0, err
+	// Mix in the pre-shared key, if any.
+	mixPreSharedKey(&yr, config)
+
+	// Open the initiator's extension header.
+	ext, dataLen, err := openExtensionHeader(&yr, reqExt)
+	return yr, ext, dataLen, err
+}
+
+// requestError returns the error for a request which none of the responder's static keys could open: ErrHybridMismatch
+// if the request is for the other handshake version, ErrUnsupportedVersion if it is from a version 1 initiator, or
+// ErrInvalidHandshake.
+func requestError(r io.Reader, req []byte, keys []*PrivateKey, ie *PublicKey, config *Config) error {
+	other := *config
+	other.Hybrid = !config.Hybrid
+	if isDiscoverRequest(req[:discoverReqLen], &other) {
+		return ErrHybridMismatch
 	}
-	header = c.recv.Decrypt("header", header[:1], header[4:])
-	messageLen := int(binary.BigEndian.Uint32(header))
 
-	// If the header is all-zeroes, the message is an encrypted ephemeral public key and we need to ratchet.
-	if messageLen == 0 {
-		ratchetCT := allocSlice(c.recvBuf[:0], pointLen+lockstitch.TagLen)
-		if _, err := io.ReadFull(c.rw, ratchetCT); err != nil {
-			return 0, err
-		}
-		ratchetCT, err = c.recv.Open("message", ratchetCT[:0], ratchetCT)
-		if err != nil {
-			return 0, err
-		}
-		ephemeral, err := NewPublicKey(ratchetCT)
-		if err != nil {
-			return 0, err
-		}
-		ss, err := c.localKey.ECDH(ephemeral)
-		if err != nil {
-			return 0, err
+	for _, k := range keys {
+		if _, _, _, err := openRequest(k, ie, req[:elligatorPointLen], req[elligatorPointLen:discoverReqLen], &other); err == nil {
+			return ErrHybridMismatch
 		}
-		c.send.Mix("ratchet-ss", ss)
-
-		// Re-try the read.
-		return c.Read(p)
 	}
 
-	// Otherwise, read and open the message.
-	message := allocSlice(c.recvBuf[:0], messageLen+lockstitch.TagLen)
-	if _, err := io.ReadFull(c.rw, message); err != nil {
-		return 0, err
+	// Every request is at least as long as a version 1 request, so this doesn't block.
+	if _, err := io.ReadFull(r, req[discoverReqLen:v1ReqLen]); err != nil {
+		return ErrInvalidHandshake
 	}
-	message, err = c.recv.Open("message", message[:0], message)
-	if err != nil {
-		return 0, err
+	for _, k := range keys {
+		if isV1Request(k, ie, req[:v1ReqLen]) {
+			return ErrUnsupportedVersion
+		}
 	}
-	c.msgBuf = message
-
-	// Satisfy the read with the buffered contents.
-	return c.Read(p)
+	return ErrInvalidHandshake
 }
 
-func (c *connection) Write(p []byte) (n int, err error) {
-	if len(p) > 1<<24 {
-		panic("packet too large")
+// isV1Request returns true if the request is from a version 1 initiator, which sealed its static public key directly
+// after its ephemeral public key.
+func isV1Request(rs *PrivateKey, ie *PublicKey, req []byte) bool {
+	yr := lockstitch.NewProtocol("yrgourd.v1")
+	yr.Mix("rs", rs.PublicKey().Bytes())
+	yr.Mix("ie", req[:elligatorPointLen])
+
+	ssIERS, err := rs.ECDH(ie)
+	if err != nil {
+		return false
 	}
+	yr.Mix("ie-rs", ssIERS)
 
-	// Check to see if we need to ratchet the connection state.
-	c.sentBytes += len(p)
-	if now := time.Now(); c.sentBytes > c.ratchetAfterBytes || now.Sub(c.lastRatchet) > c.ratchetAfterTime {
-		// Reset the ratchet byte counter and timestamp.
-		c.sentBytes = 0
-		c.lastRatchet = now
-
-		// Generate an ephemeral key pair.
-		ephemeral, err := GenerateKey(c.rand)
-		if err != nil {
-			return 0, err
+	_, err = yr.Open("is", nil, req[elligatorPointLen:])
+	return err == nil
+}
+
+// InitiateAny performs a handshake with a responder whose static public key is not known in advance, but which is
+// accepted by the policy. The responder sends its static public key encrypted with the ephemeral-ephemeral shared
+// secret, hiding it from passive observers, and the initiator only reveals its own static public key if the policy
+// accepts the responder's. This is similar to the Noise XX pattern, and is useful when initiators trust a set of
+// responders rather than a single key.
+//
+// The responder must set Config.AllowDiscovery. Note that an active attacker can still learn the responder's static
+// public key by initiating a handshake of their own, and unless both peers set Config.PreSharedKey, a passive observer
+// can tell that the handshake is a discovery handshake.
+func InitiateAny(rw io.ReadWriter, is *PrivateKey, policy func(key *PublicKey) bool, rand io.Reader, config *Config) (*Conn, error) {
+	return initiateDiscover(rw, is, rand, config, func(rs *PublicKey) error {
+		if !policy(rs) {
+			return fmt.Errorf("%w: %s", ErrResponderNotAllowed, Fingerprint(rs))
 		}
+		return nil
+	})
+}
 
-		// Encrypt an all-zeroes header.
-		header := allocSlice(c.sendBuf[:0], 4)
-		header = c.send.Encrypt("header", header[:0], header[:3])
+// initiateDiscover performs a handshake with a responder whose static public key is not known in advance. The
+// responder sends its static public key encrypted with the ephemeral-ephemeral shared secret, and verify is called with
+// it before the initiator reveals its own static public key.
+func initiateDiscover(rw io.ReadWriter, is *PrivateKey, rand io.Reader, config *Config, verify func(rs *PublicKey) error) (*Conn, error) {
+	if config == nil {
+		config = &DefaultConfig
+	}
 
-		// Seal the ephemeral public key, append it to the header, and send both.
-		message := c.send.Seal("message", header, ephemeral.PublicKey().Bytes())
-		if n, err := c.rw.Write(message); err != nil {
-			return n, err
-		}
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
 
-		// Calculate and mix in the shared secret.
-		ss, err := ephemeral.ECDH(c.remoteKey)
-		if err != nil {
-			return 0, err
-		}
-		c.send.Mix("ratchet-ss", ss)
+	// Generate an ephemeral key pair.
+	ie, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
 	}
 
-	// Encode a header with a 3-byte big endian message length and encrypt it.
-	header := allocSlice(c.sendBuf[:0], 4)
-	binary.BigEndian.PutUint32(header, uint32(len(p)))
-	header = c.send.Encrypt("header", header[1:1], header[1:])
+	// Initialize a protocol and mix in an empty responder static public key.
+	yr := newProtocol(config)
+	yr.Mix("rs", nil)
 
-	// Seal the message, append it to the header, and send it.
-	message := c.send.Seal("message", header, p)
-	if _, err := c.rw.Write(message); err != nil {
-		return 0, err
+	// Mix the initiator's encoded ephemeral public key into the protocol.
+	req, err := elligator.Encode(ie.PublicKey().Bytes(), rand)
+	if err != nil {
+		return nil, err
 	}
+	yr.Mix("ie", req)
 
-	return len(p), nil
-}
+	// Mix in the pre-shared key, if any.
+	mixPreSharedKey(&yr, config)
 
-func allocSlice(in []byte, n int) []byte {
-	var head []byte
-	if total := len(in) + n; cap(in) >= total {
-		head = in[:total]
-	} else {
-		head = make([]byte, total)
-		copy(head, in)
+	// Generate the initiator's initial ratchet key.
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
 	}
-	return head[len(in):]
-}
 
-const (
-	elligatorPointLen = 64
-	pointLen          = 65
+	// Seal the initiator's extensions, which also mark the request as a discovery request, and send it.
+	local := localExtensions(config)
+	local.setPayloadLen(len(config.EarlyData))
+	local.setRatchetKey(ratchetKey.PublicKey())
+	local.padRequest()
+	req = local.seal(&yr, req)
+	if _, err := rw.Write(req); err != nil {
+		return nil, err
+	}
 
-	// elligator(ie) + is + tag
-	reqLen = elligatorPointLen + pointLen + lockstitch.TagLen
-	// re + tag
-	respLen = pointLen + lockstitch.TagLen
+	// Read the response.
+	resp := make([]byte, discoverRespLen)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return nil, err
+	}
+
+	// Mix in and decode the responder's ephemeral public key.
+	respRE, respRS := resp[:elligatorPointLen], resp[elligatorPointLen:]
+	yr.Mix("re", respRE)
+	respRE, err = elligator.Decode(respRE)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	re, err := NewPublicKey(respRE)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	// Calculate and mix in the ephemeral-ephemeral shared secret.
+	ssIERE, err := ie.ECDH(re)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-re", ssIERE)
+
+	// Open and decode the responder's static public key.
+	respRS, err = yr.Open("rs", respRS[:0], respRS)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	rs, err := NewPublicKey(respRS)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	// Check the responder's static public key before revealing our own.
+	if err := verify(rs); err != nil {
+		return nil, err
+	}
+
+	// Calculate and mix in the ephemeral-static shared secret.
+	ssIERS, err := ie.ECDH(rs)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-rs", ssIERS)
+
+	// Read the responder's extensions, which hold the negotiated version and features.
+	negotiated, err := readExtensions(rw, &yr)
+	if err != nil {
+		return nil, err
+	}
+	if err := local.checkReply(negotiated); err != nil {
+		return nil, err
+	}
+	remoteRatchetKey, err := negotiated.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the response data, if any.
+	responseData, err := readPayload(rw, &yr, negotiated)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the handshake is hybrid, read the responder's ML-KEM encapsulation key.
+	var ek *mlkem.EncapsulationKey768
+	if config.Hybrid {
+		ek, err = openKEMKey(rw, &yr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Seal the initiator's static public key.
+	fin := yr.Seal("is", make([]byte, 0, discoverFinLen), is.PublicKey().Bytes())
+
+	// Calculate and mix in the static-ephemeral shared secret.
+	ssISRE, err := is.ECDH(re)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("is-re", ssISRE)
+
+	// Calculate and mix in the static-static shared secret.
+	ssISRS, err := is.ECDH(rs)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("is-rs", ssISRS)
+
+	// Seal the early data, if any.
+	fin = sealPayload(&yr, fin, config.EarlyData)
+
+	// If the handshake is hybrid, encapsulate a shared secret to the responder's ML-KEM key.
+	if config.Hybrid {
+		fin = sealKEMCiphertext(&yr, fin, ek)
+	}
+
+	// Send the sealed initiator's static public key, early data, and ML-KEM ciphertext, if any.
+	if _, err := rw.Write(fin); err != nil {
+		return nil, err
+	}
+
+	conn := newConnection(rw, &yr, true, is, rs, ratchetKey, remoteRatchetKey, rand, config, negotiated.state(negotiated, config))
+	conn.earlyData, conn.responseData = config.EarlyData, responseData
+	return conn, nil
+}
+
+// isDiscoverRequest returns true if the request was sent by initiateDiscover. The check needs no secrets other than the
+// pre-shared key, if any, so anyone else can make it too.
+func isDiscoverRequest(req []byte, config *Config) bool {
+	yr := newProtocol(config)
+	yr.Mix("rs", nil)
+	yr.Mix("ie", req[:elligatorPointLen])
+	mixPreSharedKey(&yr, config)
+	_, err := yr.Open("ext", nil, req[elligatorPointLen:])
+	return err == nil
+}
+
+// respondDiscover completes a discovery handshake, sending the responder's static public key to the initiator.
+func respondDiscover(rw io.ReadWriter, rs *PrivateKey, req []byte, rand io.Reader, config *Config, policy func(key *PublicKey, earlyData []byte) bool) (*Conn, error) {
+	// Initialize a protocol and mix in an empty responder static public key.
+	yr := newProtocol(config)
+	yr.Mix("rs", nil)
+
+	// Mix in the initiator's encoded ephemeral public key and read the initiator's extensions.
+	reqIE, reqExt := req[:elligatorPointLen], req[elligatorPointLen:]
+	yr.Mix("ie", reqIE)
+	mixPreSharedKey(&yr, config)
+	peer, dataLen, err := openExtensionHeader(&yr, reqExt)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.readData(rw, &yr, dataLen); err != nil {
+		return nil, err
+	}
+
+	// Decode the initiator's ephemeral public key.
+	reqIE, err = elligator.Decode(reqIE)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	ie, err := NewPublicKey(reqIE)
+	if err != nil {
+		panic(err) // should never happen
+	}
+
+	// Generate an ephemeral key pair and mix in its encoded public key.
+	re, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := elligator.Encode(re.PublicKey().Bytes(), rand)
+	if err != nil {
+		return nil, err
+	}
+	yr.Mix("re", resp)
+
+	// Calculate and mix in the ephemeral-ephemeral shared secret.
+	ssIERE, err := re.ECDH(ie)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-re", ssIERE)
+
+	// Seal the responder's static public key.
+	resp = yr.Seal("rs", resp, rs.PublicKey().Bytes())
+
+	// Calculate and mix in the ephemeral-static shared secret.
+	ssIERS, err := rs.ECDH(ie)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("ie-rs", ssIERS)
+
+	// Read the initiator's initial ratchet key and generate the responder's.
+	remoteRatchetKey, err := peer.ratchetKey()
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seal the negotiated version and features, the responder's initial ratchet key, and the response data, if any.
+	negotiated := localExtensions(config).negotiate(peer)
+	negotiated.setPayloadLen(len(config.ResponseData))
+	negotiated.setRatchetKey(ratchetKey.PublicKey())
+	resp = negotiated.seal(&yr, resp)
+	resp = sealPayload(&yr, resp, config.ResponseData)
+
+	// If the handshake is hybrid, generate an ML-KEM key pair and seal its encapsulation key.
+	var dk *mlkem.DecapsulationKey768
+	if config.Hybrid {
+		resp, dk, err = sealKEMKey(&yr, resp, rand)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Send the response.
+	if _, err := rw.Write(resp); err != nil {
+		return nil, err
+	}
+
+	// Read, open, and decode the initiator's static public key.
+	fin := make([]byte, discoverFinLen)
+	if _, err := io.ReadFull(rw, fin); err != nil {
+		return nil, err
+	}
+	fin, err = yr.Open("is", fin[:0], fin)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	is, err := NewPublicKey(fin)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	// Calculate and mix in the static-ephemeral shared secret.
+	ssISRE, err := re.ECDH(is)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("is-re", ssISRE)
+
+	// Calculate and mix in the static-static shared secret.
+	ssISRS, err := rs.ECDH(is)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	yr.Mix("is-rs", ssISRS)
+
+	// Read the early data, if any.
+	earlyData, err := readPayload(rw, &yr, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the initiator's static public key and early data against the policy.
+	if !policy(is, earlyData) {
+		return nil, fmt.Errorf("%w: %s", ErrInitiatorNotAllowed, Fingerprint(is))
+	}
+
+	// If the handshake is hybrid, read the initiator's ML-KEM ciphertext and mix in the shared secret.
+	if config.Hybrid {
+		if err := openKEMCiphertext(rw, &yr, dk); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := newConnection(rw, &yr, false, rs, is, ratchetKey, remoteRatchetKey, rand, config, negotiated.state(peer, config))
+	conn.earlyData, conn.responseData = earlyData, config.ResponseData
+	return conn, nil
+}
+
+// checkConfig returns an error if the configured pre-shared key, if any, is the wrong length, or if the configured
+// handshake payloads are too large.
+func checkConfig(config *Config) error {
+	if config.PreSharedKey != nil && len(config.PreSharedKey) != PreSharedKeyLen {
+		return ErrInvalidPreSharedKey
+	}
+	if len(config.EarlyData) > MaxPayloadLen || len(config.ResponseData) > MaxPayloadLen {
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
+
+// mixPreSharedKey mixes the configured pre-shared key, if any, into the protocol.
+func mixPreSharedKey(yr *lockstitch.Protocol, config *Config) {
+	if config.PreSharedKey != nil {
+		yr.Mix("psk", config.PreSharedKey)
+	}
+}
+
+// Conn is an encrypted, authenticated connection established by Initiate or Respond.
+type Conn struct {
+	rw                       io.ReadWriter
+	recv                     lockstitch.Protocol
+	send                     lockstitch.Protocol
+	recvBuf, msgBuf, sendBuf []byte
+	padBuf                   []byte
+	padding                  PaddingPolicy
+	shaper                   *shaper
+	keepalive                *keepalive
+	ratchetTimer             *ratchetTimer
+	ratchetKeys              *ratchetKeys
+	writeMu                  sync.Mutex
+	ponging                  atomic.Bool
+	stats                    connStats
+	readErr                  error
+	earlyData, responseData  []byte
+	exporterSecret           []byte
+	channelBinding           []byte
+	resumptionSecret         []byte
+	sessions                 *SessionCache
+	ticketSent               chan struct{} // closed once the resumption ticket, if any, has been sent
+	localKey                 *PrivateKey
+	remoteKey                *PublicKey
+	rand                     io.Reader
+	initiator                bool
+	state                    ConnectionState
+	maxFrameSize             int
+	ratchetMu                sync.Mutex
+	rekeying                 atomic.Bool
+	sentBytes                int
+	lastRatchet              time.Time
+	ratchetAfterBytes        int
+	ratchetAfterTime         time.Duration
+}
+
+// ConnectionState describes the parameters negotiated during the handshake.
+type ConnectionState struct {
+	// Version is the negotiated protocol version.
+	Version int
+
+	// Features is the set of optional features both peers support.
+	Features Features
+
+	// Hybrid is true if the connection was established with the hybrid yrgourd.v2 handshake.
+	Hybrid bool
+
+	// Anonymous is true if the initiator did not authenticate itself (see InitiateAnonymous).
+	Anonymous bool
+
+	// Resumed is true if the connection was established with an abbreviated handshake using a resumption ticket.
+	Resumed bool
+
+	// MaxFrameSize is the largest frame payload, in bytes, the remote peer will accept.
+	MaxFrameSize int
+}
+
+// newConnection returns a connection using the protocol of a completed handshake.
+func newConnection(rw io.ReadWriter, yr *lockstitch.Protocol, initiator bool, localKey *PrivateKey, remoteKey *PublicKey, ratchetKey *PrivateKey, remoteRatchetKey *PublicKey, rand io.Reader, config *Config, state ConnectionState) *Conn {
+	// Derive the exporter, channel binding, and resumption secrets, then fork the protocol into recv and send protocols.
+	exporterSecret, channelBinding, resumptionSecret := exportSecrets(yr)
+	recv, send := fork(yr)
+	if !initiator {
+		recv, send = send, recv
+	}
+
+	// The handshake is complete, so stop recording it before anything else uses the connection.
+	if rec, ok := rw.(*recordingReader); ok {
+		rw = rec.ReadWriter
+	}
+
+	c := &Conn{
+		rw:                rw,
+		recv:              recv,
+		send:              send,
+		exporterSecret:    exporterSecret,
+		channelBinding:    channelBinding,
+		resumptionSecret:  resumptionSecret,
+		localKey:          localKey,
+		remoteKey:         remoteKey,
+		rand:              rand,
+		initiator:         initiator,
+		state:             state,
+		maxFrameSize:      maxFrameSize(config),
+		lastRatchet:       time.Now(),
+		ratchetAfterBytes: config.RatchetAfterBytes,
+		ratchetAfterTime:  config.RatchetAfterTime,
+	}
+
+	// If both peers support it, ratchet with ephemeral keys on both sides, starting with the initial ratchet keys.
+	if state.Features&FeatureEphemeralRatchet != 0 {
+		c.ratchetKeys = newRatchetKeys(ratchetKey, remoteRatchetKey)
+
+		// An anonymous initiator's stand-in static key is only used to ratchet, so don't keep it past the first ratchet.
+		if state.Anonymous && initiator {
+			c.localKey = nil
+		}
+	}
+
+	// Only pad frames if the remote peer can strip the padding.
+	if state.Features&FeaturePadding != 0 {
+		c.padding = config.Padding
+	}
+
+	// Only shape traffic if the remote peer can strip the padding and discard cover frames.
+	if s := config.Shaping; s != nil && s.Interval > 0 && state.Features&(FeaturePadding|FeatureCoverTraffic) == FeaturePadding|FeatureCoverTraffic {
+		c.shaper = newShaper(s, state.MaxFrameSize)
+		go c.shape()
+	}
+
+	// Send keepalives and detect dead peers, if configured.
+	if c.keepalive = newKeepalive(config, state); c.keepalive != nil {
+		go c.sendKeepalives()
+	}
+
+	// Ratchet idle connections, if configured.
+	if c.ratchetTimer = newRatchetTimer(config); c.ratchetTimer != nil {
+		go c.ratchetPeriodically()
+	}
+
+	// If both peers support resumption tickets, the initiator stores the tickets it receives and the responder issues
+	// one right away, even if it never writes anything else. The ticket is sent in the background, so the handshake
+	// doesn't wait for the initiator to read it. Datagram connections don't carry frames, so they get no tickets.
+	if state.Features&FeatureTickets != 0 {
+		_, datagram := rw.(*datagramHandshake)
+		if initiator {
+			c.sessions = config.SessionCache
+		} else if ticket := issueTicket(c, config); ticket != nil && !datagram {
+			c.ticketSent = make(chan struct{})
+			go func() {
+				defer close(c.ticketSent)
+				_ = c.sendFrame(frameTicket, ticket, nil)
+			}()
+		}
+	}
+	return c
+}
+
+// LocalKey returns the static public key used by the local peer, or nil if the local peer is an anonymous initiator.
+func (c *Conn) LocalKey() *PublicKey {
+	if c.state.Anonymous && c.initiator {
+		return nil
+	}
+	return c.localKey.PublicKey()
+}
+
+// RemoteKey returns the static public key of the remote peer, or nil if the remote peer is an anonymous initiator.
+func (c *Conn) RemoteKey() *PublicKey {
+	if c.state.Anonymous && !c.initiator {
+		return nil
+	}
+	return c.remoteKey
+}
+
+// EarlyData returns the early data sent by the initiator, if any. See Config.EarlyData for its security properties.
+func (c *Conn) EarlyData() []byte {
+	return c.earlyData
+}
+
+// ResponseData returns the response data sent by the responder, if any.
+func (c *Conn) ResponseData() []byte {
+	return c.responseData
+}
+
+// ConnectionState returns the parameters negotiated during the handshake.
+func (c *Conn) ConnectionState() ConnectionState {
+	return c.state
+}
+
+// Close sends a close_notify frame, if negotiated, and closes the underlying connection, if it implements io.Closer.
+func (c *Conn) Close() error {
+	// Don't let an unresponsive peer block the close indefinitely.
+	if d, ok := c.rw.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		_ = d.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+	}
+
+	// Stop sending keepalives and ratcheting in the background.
+	if c.keepalive != nil {
+		c.keepalive.stop()
+	}
+	if c.ratchetTimer != nil {
+		c.ratchetTimer.stop()
+	}
+
+	// Let the resumption ticket, if any, go out before the close_notify frame.
+	if c.ticketSent != nil {
+		<-c.ticketSent
+	}
+
+	var err error
+	if c.state.Features&FeatureCloseNotify != 0 {
+		err = c.sendFrame(frameCloseNotify, nil, nil)
+	}
+
+	// Stop sending cover frames.
+	if c.shaper != nil {
+		c.shaper.stop()
+	}
+
+	if closer, ok := c.rw.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+// Read reads decrypted data from the connection. If the remote peer closed the connection with a close_notify frame,
+// Read returns io.EOF; otherwise, an unexpected end of the underlying connection is returned as is.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+
+	// If we don't have any buffered message contents, read the next message.
+	for len(c.msgBuf) == 0 {
+		if c.msgBuf, err = c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = min(len(c.msgBuf), len(p))
+	copy(p, c.msgBuf[:n])
+	c.msgBuf = c.msgBuf[n:]
+	return n, nil
+}
+
+// ReadMessage reads the contents of the next data frame sent by the remote peer, preserving the boundaries of the
+// remote peer's calls to WriteMessage. The returned slice is only valid until the next call to Read or ReadMessage. If
+// a previous call to Read left part of a frame unread, ReadMessage returns the rest of it.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	if len(c.msgBuf) > 0 {
+		msg := c.msgBuf
+		c.msgBuf = nil
+		return msg, nil
+	}
+	return c.readMessage()
+}
+
+// readMessage reads frames until a data frame is read, handling any control frames, and returns its contents.
+func (c *Conn) readMessage() ([]byte, error) {
+	// If the remote peer has closed the connection, don't read any further.
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+
+	// Only time out the remote peer while waiting for it.
+	if c.keepalive != nil {
+		c.keepalive.startReading()
+		defer c.keepalive.stopReading()
+	}
+
+	for {
+		frameType, body, err := c.readFrame()
+		if err != nil {
+			// If the remote peer would have sent a close_notify frame, the connection was truncated.
+			if errors.Is(err, io.EOF) && c.state.Features&FeatureCloseNotify != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, c.timeout(err)
+		}
+
+		if err := c.handleFrame(frameType, body); err != nil {
+			return nil, err
+		}
+
+		if frameType == frameData {
+			c.stats.dataBytesReceived.Add(int64(len(body)))
+			return body, nil
+		}
+
+		if c.readErr != nil {
+			return nil, c.readErr
+		}
+	}
+}
+
+// handleFrame handles a frame other than a data frame.
+func (c *Conn) handleFrame(frameType byte, body []byte) error {
+	switch frameType {
+	case frameData:
+		// Data frames are returned by readMessage.
+	case frameRatchet:
+		// The frame contains an ephemeral public key and we need to ratchet.
+		ss, err := c.receiveRatchet(body)
+		if err != nil {
+			return err
+		}
+		c.recv.Mix("ratchet-ss", ss)
+	case frameCloseNotify:
+		c.readErr = io.EOF
+	case frameCover:
+		// Discard cover frames.
+		c.stats.coverFramesReceived.Add(1)
+	case framePing:
+		// Answer pings with the same contents. The pong is sent in the background, since writing it here could deadlock
+		// with a remote peer which is blocked writing to us. If a pong is already being sent, drop the ping.
+		if c.ponging.CompareAndSwap(false, true) {
+			body := bytes.Clone(body)
+			go func() {
+				defer c.ponging.Store(false)
+				_ = c.sendFrame(framePong, body, nil)
+			}()
+		}
+	case frameRekeyRequest:
+		// Ratchet in the background, for the same reason pongs are sent in the background. If a ratchet is already
+		// being sent, the request is satisfied by it.
+		if c.rekeying.CompareAndSwap(false, true) {
+			go func() {
+				defer c.rekeying.Store(false)
+				_ = c.ratchet()
+			}()
+		}
+	case framePong:
+		if c.keepalive != nil {
+			if err := c.keepalive.pong(body); err != nil {
+				return err
+			}
+		}
+	case frameTicket:
+		// Store the ticket for future connections to the responder.
+		if c.sessions != nil {
+			c.sessions.put(c.LocalKey(), c.remoteKey, &session{ticket: bytes.Clone(body), secret: c.resumptionSecret})
+		}
+	default:
+		return ErrInvalidFrame
+	}
+	return nil
+}
+
+// readFrame reads, decrypts, and opens a frame.
+func (c *Conn) readFrame() (frameType byte, body []byte, err error) {
+	// Read and decrypt the header and decode the frame type and length.
+	header := allocSlice(c.recvBuf[:0], frameHeaderLen)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return 0, nil, err
+	}
+	header = c.recv.Decrypt("header", header[:0], header)
+	frameType, frameLen := header[0], int(binary.BigEndian.Uint32(header)&maxFrameLen)
+	if frameLen > c.maxFrameSize {
+		return 0, nil, ErrInvalidFrame
+	}
+
+	// Read and open the frame body.
+	body = allocSlice(c.recvBuf[:0], frameLen+lockstitch.TagLen)
+	if _, err := io.ReadFull(c.rw, body); err != nil {
+		return 0, nil, err
+	}
+	body, err = c.recv.Open("message", body[:0], body)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.stats.framesReceived.Add(1)
+	if c.keepalive != nil {
+		c.keepalive.received()
+	}
+	c.stats.bytesReceived.Add(int64(frameHeaderLen + frameLen + lockstitch.TagLen))
+
+	// Strip the padding, if any.
+	if frameType&framePadded != 0 {
+		if c.state.Features&FeaturePadding == 0 {
+			return 0, nil, ErrInvalidFrame
+		}
+		frameType &^= framePadded
+		if body, err = unpad(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	return frameType, body, nil
+}
+
+// Write encrypts and writes data to the connection, splitting it into frames no larger than the remote peer's maximum
+// frame size.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	frameSize := c.MaxMessageSize()
+	for len(p) > 0 {
+		frame := p[:min(len(p), frameSize)]
+		if err := c.writeMessage(frame); err != nil {
+			return n, err
+		}
+		n += len(frame)
+		p = p[len(frame):]
+	}
+	return n, nil
+}
+
+// WriteMessage encrypts and writes p to the connection as a single data frame, which the remote peer can read with
+// ReadMessage. p may be at most MaxMessageSize bytes long.
+func (c *Conn) WriteMessage(p []byte) error {
+	if len(p) > c.MaxMessageSize() {
+		return ErrMessageTooLarge
+	}
+	return c.writeMessage(p)
+}
+
+// MaxMessageSize returns the largest message, in bytes, which can be written with WriteMessage. This depends on the
+// remote peer's maximum frame size and whether or not frames are padded or shaped.
+func (c *Conn) MaxMessageSize() int {
+	// Leave room for the padded frame's content length.
+	if c.shaper != nil {
+		return c.shaper.slotSize - paddedHeaderLen
+	} else if c.padding != nil {
+		return c.state.MaxFrameSize - paddedHeaderLen
+	}
+	return c.state.MaxFrameSize
+}
+
+// writeMessage writes p as a data frame.
+func (c *Conn) writeMessage(p []byte) error {
+	// Send data only after the resumption ticket, if any, so the initiator has the ticket once it has read the data.
+	if c.ticketSent != nil {
+		<-c.ticketSent
+	}
+
+	// Check to see if we need to ratchet the connection state.
+	if err := c.maybeRatchet(len(p)); err != nil {
+		return err
+	}
+
+	if err := c.sendFrame(frameData, p, nil); err != nil {
+		return err
+	}
+	c.stats.dataBytesSent.Add(int64(len(p)))
+	return nil
+}
+
+// Ratchet immediately ratchets the connection in both directions: it sends a ratchet frame and, if the remote peer
+// supports FeatureRekey, asks the remote peer to send one as well. The remote peer ratchets once it reads the request.
+// Ratchet may be called concurrently with Read and Write.
+func (c *Conn) Ratchet() error {
+	if err := c.ratchet(); err != nil {
+		return err
+	}
+
+	if c.state.Features&FeatureRekey == 0 {
+		return nil
+	}
+	return c.sendFrame(frameRekeyRequest, nil, nil)
+}
+
+// receiveRatchet returns the shared secret for a ratchet frame.
+func (c *Conn) receiveRatchet(body []byte) ([]byte, error) {
+	if c.ratchetKeys != nil {
+		return c.ratchetKeys.receive(body)
+	}
+
+	ephemeral, err := NewPublicKey(body)
+	if err != nil {
+		return nil, err
+	}
+	return c.localKey.ECDH(ephemeral)
+}
+
+// maybeRatchet sends a ratchet frame if enough bytes have been sent or enough time has passed since the last ratchet.
+func (c *Conn) maybeRatchet(n int) error {
+	c.ratchetMu.Lock()
+	c.sentBytes += n
+	due := c.sentBytes > c.ratchetAfterBytes || time.Since(c.lastRatchet) > c.ratchetAfterTime
+	c.ratchetMu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return c.ratchet()
+}
+
+// ratchet sends a ratchet frame and mixes the shared secret into the send protocol.
+func (c *Conn) ratchet() error {
+	// Hold the lock until the frame is sent, so that ratchet frames are sent in the order their keys are generated.
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
+	// Reset the ratchet byte counter and timestamp.
+	c.sentBytes = 0
+	c.lastRatchet = time.Now()
+
+	// Generate an ephemeral key pair.
+	ephemeral, err := GenerateKey(c.rand)
+	if err != nil {
+		return err
+	}
+
+	// Calculate the shared secret with the remote peer's latest ratchet key, if both peers support it, or its static
+	// key.
+	var body, ss []byte
+	if c.ratchetKeys != nil {
+		body, ss, err = c.ratchetKeys.send(ephemeral)
+	} else {
+		body = ephemeral.PublicKey().Bytes()
+		ss, err = ephemeral.ECDH(c.remoteKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send the ephemeral public key and mix in the shared secret.
+	return c.sendFrame(frameRatchet, body, func() {
+		c.send.Mix("ratchet-ss", ss)
+	})
+}
+
+// sendFrame writes a frame, or waits for a slot to send it in if the connection is shaped, and then calls after, if not
+// nil, before any other frame is written.
+func (c *Conn) sendFrame(frameType byte, body []byte, after func()) error {
+	if c.shaper != nil {
+		return c.timeout(c.shaper.send(frameType, body, after))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.writeFrame(frameType, body); err != nil {
+		return c.timeout(err)
+	}
+	if after != nil {
+		after()
+	}
+	return nil
+}
+
+// writeFrame pads, if configured, encrypts, and writes a frame of the given type.
+func (c *Conn) writeFrame(frameType byte, body []byte) error {
+	// Pad the body, if configured.
+	if c.padding != nil {
+		c.padBuf = pad(c.padBuf[:0], body, c.padding, c.state.MaxFrameSize)
+		frameType |= framePadded
+		body = c.padBuf
+	}
+	return c.writeRawFrame(frameType, body)
+}
+
+// writeRawFrame encrypts and writes a frame of the given type without padding it.
+func (c *Conn) writeRawFrame(frameType byte, body []byte) error {
+	// Encode a header with the frame type and a 3-byte big endian frame length and encrypt it.
+	header := allocSlice(c.sendBuf[:0], frameHeaderLen)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	header[0] = frameType
+	header = c.send.Encrypt("header", header[:0], header)
+
+	// Seal the body, append it to the header, and send it.
+	frame := c.send.Seal("message", header, body)
+	if _, err := c.rw.Write(frame); err != nil {
+		return err
+	}
+	c.stats.framesSent.Add(1)
+	c.stats.bytesSent.Add(int64(len(frame)))
+	return nil
+}
+
+func allocSlice(in []byte, n int) []byte {
+	var head []byte
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	return head[len(in):]
+}
+
+// PreSharedKeyLen is the length of a pre-shared key, in bytes.
+const PreSharedKeyLen = 32
+
+// MaxPayloadLen is the maximum length of early data or response data, in bytes.
+const MaxPayloadLen = 1<<16 - 1
+
+// Frame types.
+const (
+	frameData byte = iota
+	frameRatchet
+	frameCloseNotify
+	frameTicket
+	frameCover
+	framePing
+	framePong
+	frameRekeyRequest
+)
+
+const (
+	elligatorPointLen  = 64
+	pointLen           = 65
+	compressedPointLen = 33
+
+	// type + 3-byte length
+	frameHeaderLen = 4
+	// the largest length which fits in a frame header
+	maxFrameLen = 1<<24 - 1
+	// the smallest maximum frame size a peer may advertise
+	minFrameSize = 1024
+
+	closeNotifyTimeout = 5 * time.Second
+
+	// elligator(ie) + ext + is + tag
+	reqLen = elligatorPointLen + extLen + pointLen + lockstitch.TagLen
+	// re + tag
+	respLen = pointLen + lockstitch.TagLen
+
+	// elligator(ie) + ext
+	discoverReqLen = elligatorPointLen + extLen
+	// elligator(ie) + is + tag, as sent by a version 1 initiator
+	v1ReqLen = elligatorPointLen + pointLen + lockstitch.TagLen
+	// elligator(re) + rs + tag
+	discoverRespLen = elligatorPointLen + pointLen + lockstitch.TagLen
+	// is + tag
+	discoverFinLen = pointLen + lockstitch.TagLen
 )